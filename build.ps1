@@ -4,18 +4,20 @@ if ($VER -match '^([^-]+)-(\d+)-(g[0-9a-f]+)$') {
     $hash = $Matches[3]
     $VER  = "$tag($hash)"
 }
+$DATE = (Get-Date).ToUniversalTime().ToString("yyyy-MM-ddTHH:mm:ssZ")
+$LDFLAGS = "-X main.version=${VER} -X main.buildDate=${DATE}"
 
 # Build for Linux
 Write-Host "Building $VER for Linux..."
 $env:GOOS = "linux"
 $env:GOARCH = "amd64"
-go build -ldflags "-X main.version=${VER}" -o .\release\MergeOrderLog main.go
+go build -ldflags "${LDFLAGS}" -o .\release\MergeOrderLog main.go
 
 # Build for Windows
 Write-Host "Building $VER for Windows..."
 $env:GOOS = "windows"
 $env:GOARCH = "amd64"
-go build -ldflags "-X main.version=${VER}" -o .\release\MergeOrderLog.exe main.go
+go build -ldflags "${LDFLAGS}" -o .\release\MergeOrderLog.exe main.go
 
 Write-Host "Builds completed."
 
@@ -10,12 +10,15 @@ if [[ $version =~ ^([^-]+)-([0-9]+)-(g[0-9a-f]+)$ ]]; then
   version="${tag}(${hash})"
 fi
 
+buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+ldflags="-X main.version=${version} -X main.buildDate=${buildDate}"
+
 # Build for Linux
 echo "Building $version for Linux..."
-GOOS=linux GOARCH=amd64 go build -ldflags "-X main.version=${version}" -o ./release/MergeOrderLog main.go
+GOOS=linux GOARCH=amd64 go build -ldflags "${ldflags}" -o ./release/MergeOrderLog main.go
 
 # Build for Windows
 echo "Building $version for Windows..."
-GOOS=windows GOARCH=amd64 go build -ldflags "-X main.version=${version}" -o ./release/MergeOrderLog.exe main.go
+GOOS=windows GOARCH=amd64 go build -ldflags "${ldflags}" -o ./release/MergeOrderLog.exe main.go
 
 echo "Builds completed."
@@ -0,0 +1,132 @@
+package logmerge
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// atomicFile is an output written under a temporary name in the folder of its
+// destination and renamed into place by Commit, so readers never see it half
+// written. A stream destination (see isStream), which cannot be renamed
+// over, is written directly instead.
+type atomicFile struct {
+	*os.File
+	path       string // destination; "" when written directly
+	closed     bool
+	descriptor bool // a pre-opened descriptor, left open for later writes
+}
+
+func createAtomic(path string) (*atomicFile, error) {
+	if fd, ok := descriptorPath(path); ok {
+		return &atomicFile{File: descriptorFile(fd, path), descriptor: true}, nil
+	}
+	if isStream(path) {
+		// Without O_CREATE and O_TRUNC, and write-only so a named pipe
+		// waits for its reader rather than counting this process as one
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &atomicFile{File: f}, nil
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	// CreateTemp uses 0600; match what os.Create gives under the usual umask
+	f.Chmod(0644)
+	return &atomicFile{File: f, path: path}, nil
+}
+
+// isStream reports whether path is written as a stream rather than replaced:
+// a pre-opened descriptor such as /dev/stdout or /dev/fd/3, or an existing
+// file that is not a regular one, such as a named pipe or /dev/tty.
+func isStream(path string) bool {
+	if _, ok := descriptorPath(path); ok {
+		return true
+	}
+	info, err := os.Stat(path)
+	return err == nil && !info.Mode().IsRegular()
+}
+
+// descriptorPath returns the descriptor named by /dev/stdout, /dev/stderr,
+// /dev/fd/N or /proc/self/fd/N. Writing to the descriptor itself, rather than
+// opening the path again, keeps its offset and append mode, so a shell's
+// ">> file" is honored.
+func descriptorPath(path string) (uintptr, bool) {
+	switch path {
+	case "/dev/stdout":
+		return 1, true
+	case "/dev/stderr":
+		return 2, true
+	}
+	for _, dir := range []string{"/dev/fd/", "/proc/self/fd/"} {
+		if n, ok := strings.CutPrefix(path, dir); ok {
+			if fd, err := strconv.ParseUint(n, 10, 32); err == nil {
+				return uintptr(fd), true
+			}
+		}
+	}
+	return 0, false
+}
+
+var (
+	descriptorsMu sync.Mutex
+	descriptors   = map[uintptr]*os.File{1: os.Stdout, 2: os.Stderr}
+)
+
+// descriptorFile returns the *os.File for fd, the same one every time: a
+// second one would close fd once it is garbage collected.
+func descriptorFile(fd uintptr, name string) *os.File {
+	descriptorsMu.Lock()
+	defer descriptorsMu.Unlock()
+	f, ok := descriptors[fd]
+	if !ok {
+		f = os.NewFile(fd, name)
+		descriptors[fd] = f
+	}
+	return f
+}
+
+// Commit closes the file and renames it to its destination. A descriptor is
+// left open.
+func (f *atomicFile) Commit() error {
+	f.closed = true
+	if f.descriptor {
+		return nil
+	}
+	if err := f.File.Close(); err != nil {
+		if f.path != "" {
+			os.Remove(f.Name())
+		}
+		return err
+	}
+	if f.path == "" {
+		return nil
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// Close discards the file unless it was committed, so it can be deferred to
+// clean up after any failure.
+func (f *atomicFile) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	if f.descriptor {
+		return nil
+	}
+	err := f.File.Close()
+	if f.path != "" {
+		os.Remove(f.Name())
+	}
+	return err
+}
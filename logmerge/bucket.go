@@ -0,0 +1,230 @@
+package logmerge
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// unknownBucket names the file of the entries whose timestamp could not be
+// parsed.
+const unknownBucket = "unknown"
+
+// bucketLayouts are the Go time layouts naming the files of each Bucket.
+var bucketLayouts = map[string]string{
+	"hour": "2006-01-02-15",
+	"day":  "2006-01-02",
+}
+
+// bucketPath returns the file of bucket key derived from output:
+// FINAL_FORMATTED.log becomes FINAL_FORMATTED-2023-06-01-12.log. A ".gz"
+// suffix stays last.
+func bucketPath(output, key string) string {
+	base, gz := strings.CutSuffix(output, ".gz")
+	ext := filepath.Ext(base)
+	path := strings.TrimSuffix(base, ext) + "-" + key + ext
+	if gz {
+		path += ".gz"
+	}
+	return path
+}
+
+// bucketFile is the open file of one bucket.
+type bucketFile struct {
+	file *atomicFile
+	gz   *gzip.Writer
+	w    io.Writer
+}
+
+// Close completes the bucket file and commits it.
+func (b *bucketFile) Close() error {
+	if b.gz != nil {
+		if err := b.gz.Close(); err != nil {
+			b.file.Close()
+			return err
+		}
+	}
+	return b.file.Commit()
+}
+
+// bucketWriter routes runs of formatted entries to the file of their bucket.
+// Only the current bucket and the unknown one are kept open, as buckets of
+// time follow each other; the streams of SplitOutputs interleave, so they stay
+// open as long as MaxOpenFiles allows, and are otherwise closed to make room
+// and reopened when needed. Each file is written atomically (see
+// atomicFile), except that a bucket seen again (only possible with NoSort, or
+// a stream reopened) is appended to in place, with Gzip as a further gzip
+// member.
+type bucketWriter struct {
+	p      *pipeline
+	output string
+	open   map[string]*bucketFile
+	paths  []string
+	seen   map[string]bool
+}
+
+func (b *bucketWriter) writer(key string) (io.Writer, error) {
+	if f := b.open[key]; f != nil {
+		return f.w, nil
+	}
+	for open := range b.open {
+		// Besides the buckets, the ordered file is open
+		full := len(b.open) >= b.p.files.size-1
+		if open != unknownBucket && !b.p.opts.SplitOutputs || b.p.opts.SplitOutputs && full {
+			if err := b.closeFile(open); err != nil {
+				return nil, err
+			}
+		}
+	}
+	path := bucketPath(b.output, key)
+	var file *atomicFile
+	taken := b.p.files.acquire(1)
+	defer func() {
+		if b.open[key] == nil {
+			b.p.files.release(taken)
+		}
+	}()
+	appending := b.seen[key]
+	if appending {
+		appended, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, fmt.Errorf("error opening file: %v", err)
+		}
+		file = &atomicFile{File: appended}
+	} else {
+		var err error
+		if file, err = createAtomic(path); err != nil {
+			return nil, fmt.Errorf("error creating file: %v", err)
+		}
+		b.seen[key] = true
+		b.paths = append(b.paths, path)
+	}
+	f := &bucketFile{file: file, w: file}
+	if b.p.opts.Gzip {
+		var err error
+		if f.gz, err = gzip.NewWriterLevel(file, b.p.opts.GzipLevel); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("error creating gzip writer: %v", err)
+		}
+		f.w = f.gz
+	}
+	// An appended run continues the text after the byte order mark
+	f.w = encodeOutput(f.w, b.p.opts.EncodingOut, !appending)
+	b.open[key] = f
+	return f.w, nil
+}
+
+// closeFile completes the open file of bucket key.
+func (b *bucketWriter) closeFile(key string) error {
+	f := b.open[key]
+	delete(b.open, key)
+	defer b.p.files.release(1)
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	return nil
+}
+
+// discard closes every open file without committing it, after a failure.
+func (b *bucketWriter) discard() {
+	for key, f := range b.open {
+		delete(b.open, key)
+		f.file.Close()
+		b.p.files.release(1)
+	}
+}
+
+func (b *bucketWriter) close() error {
+	var firstErr error
+	for key := range b.open {
+		if err := b.closeFile(key); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// formatBuckets formats the ordered entries of inputFilePath like
+// formatSupport, but into one file per Bucket next to outputFilePath, named
+// by bucketPath. Entries go to the bucket of their parsed timestamp (in
+// Location when set), or to the unknown bucket; with SplitOutputs they go to
+// the file of their SplitBy stream instead. It returns the files
+// written, in the order they were created, even on error.
+func (p *pipeline) formatBuckets(inputFilePath, outputFilePath, dateTimePattern, delimiter string) ([]string, error) {
+	defer p.files.release(p.files.acquire(1))
+	inFile, err := os.Open(inputFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %v", err)
+	}
+	defer inFile.Close()
+
+	regex, err := regexp.Compile(dateTimePattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile regex pattern: %v", err)
+	}
+	// Colors never go into stored files
+	p.color = false
+	buckets := &bucketWriter{p: p, output: outputFilePath, open: make(map[string]*bucketFile), seen: make(map[string]bool)}
+	layout := bucketLayouts[p.opts.Bucket]
+
+	// Consecutive entries of a bucket are formatted together
+	var run strings.Builder
+	runKey := ""
+	flush := func() error {
+		if run.Len() == 0 {
+			return nil
+		}
+		w, err := buckets.writer(runKey)
+		if err != nil {
+			return err
+		}
+		if err := p.writeFormatted(strings.NewReader(run.String()), w, dateTimePattern, delimiter); err != nil {
+			return err
+		}
+		run.Reset()
+		return nil
+	}
+
+	reader := bufio.NewReader(inFile)
+	for {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			buckets.discard()
+			return buckets.paths, fmt.Errorf("error reading line: %v", readErr)
+		}
+		if readErr != nil && line == "" {
+			break
+		}
+		key := unknownBucket
+		if p.opts.SplitOutputs {
+			key = p.entryGroup(strings.TrimRight(line, "\r\n"), delimiter)
+		} else if timestamp, err := p.parseTimestampFromLine(line, regex); err == nil {
+			if p.opts.Location != nil {
+				timestamp = timestamp.In(p.opts.Location)
+			}
+			key = timestamp.Truncate(tsPrecisions[p.opts.TSPrecision]).Format(layout)
+		}
+		if key != runKey {
+			if err := flush(); err != nil {
+				buckets.discard()
+				return buckets.paths, err
+			}
+			runKey = key
+		}
+		run.WriteString(strings.TrimRight(line, "\r\n") + "\n")
+		if readErr != nil {
+			break // a last line without a newline
+		}
+	}
+	if err := flush(); err != nil {
+		buckets.discard()
+		return buckets.paths, err
+	}
+	return buckets.paths, buckets.close()
+}
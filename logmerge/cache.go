@@ -0,0 +1,220 @@
+package logmerge
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheFileName is the Incremental cache kept in the ProcessedLogs folder,
+// after the run's Prefix.
+const cacheFileName = ".cache.json"
+
+// inputCache records, per input, the processed intermediate built from it and
+// the size and modification time the input had at the time.
+type inputCache struct {
+	// Settings are the options that shape processed files; a cache written
+	// with other settings is ignored.
+	Settings string                `json:"settings"`
+	Entries  map[string]cacheEntry `json:"entries"` // by absolute input path
+}
+
+type cacheEntry struct {
+	Size        int64              `json:"size"`
+	ModTime     time.Time          `json:"modTime"`
+	Processed   string             `json:"processed"` // base name in ProcessedLogs
+	Pattern     string             `json:"pattern"`
+	LinesRead   int                `json:"linesRead"`
+	Entries     int                `json:"entries"`
+	BytesRead   int64              `json:"bytesRead"`
+	Earliest    time.Time          `json:"earliest"`
+	Latest      time.Time          `json:"latest"`
+	LF          int                `json:"lf"`
+	CRLF        int                `json:"crlf"`
+	ParseErrors []cachedParseError `json:"parseErrors,omitempty"`
+	LongLines   []int              `json:"longLines,omitempty"`
+	Fallback    bool               `json:"modTimeFallback,omitempty"`
+}
+
+type cachedParseError struct {
+	Line int    `json:"line"`
+	Text string `json:"text"`
+	Err  string `json:"err"`
+}
+
+// cacheSettings returns the Settings value for the current options.
+func (p *pipeline) cacheSettings() string {
+	data, _ := json.Marshal(struct {
+		Version                                      int
+		Delimiter, DatePattern, DateLayout, Encoding string
+		ContinuationRule, TSField                    string
+		DetectLines, AssumeYear                      int
+		MaxLineBytes                                 int64
+		LongLines                                    string
+		Formats                                      []string
+		SourceTag, Transform, JSONInput, Anchor      bool
+		FallbackModTime, MixedFormats                bool
+	}{
+		Version:          3,
+		Delimiter:        p.opts.Delimiter,
+		DatePattern:      p.opts.DatePattern,
+		DateLayout:       p.opts.DateLayout,
+		Encoding:         p.opts.Encoding,
+		ContinuationRule: p.opts.ContinuationRule,
+		DetectLines:      p.opts.DetectLines,
+		Formats:          p.opts.Formats,
+		AssumeYear:       p.opts.AssumeYear,
+		MaxLineBytes:     p.opts.MaxLineBytes,
+		LongLines:        p.opts.LongLines,
+		SourceTag:        p.opts.AnnotateSource || p.opts.Format == "json",
+		Transform:        p.opts.LineTransform != nil,
+		JSONInput:        p.opts.JSONInput,
+		Anchor:           p.opts.Anchor,
+		FallbackModTime:  p.opts.FallbackModTime,
+		MixedFormats:     p.opts.MixedFormats,
+		TSField:          p.opts.TSField,
+	})
+	return string(data)
+}
+
+// loadCache reads the cache in processFolder. A missing or unreadable cache is
+// returned empty; one written with other settings never matches in lookup.
+func (p *pipeline) loadCache(processFolder string) inputCache {
+	cache := inputCache{Settings: p.cacheSettings(), Entries: make(map[string]cacheEntry)}
+	data, err := os.ReadFile(filepath.Join(processFolder, p.opts.Prefix+cacheFileName))
+	if err != nil {
+		return cache
+	}
+	var stored inputCache
+	if err := json.Unmarshal(data, &stored); err != nil {
+		p.log.Warnf("ignoring unreadable cache: %v", err)
+		return cache
+	}
+	if stored.Entries != nil {
+		cache.Entries = stored.Entries
+	}
+	if stored.Settings != cache.Settings {
+		// The entries are kept so their files are still cleaned up, but none
+		// of them is reused
+		cache.Settings = ""
+	}
+	return cache
+}
+
+// lookup returns the result recorded for logFile if the input still has the
+// size and modification time in stamp and its processed file still exists.
+func (c inputCache) lookup(logFile string, stamp os.FileInfo, processFolder string) (FileResult, bool) {
+	if c.Settings == "" || stamp == nil {
+		return FileResult{}, false
+	}
+	e, ok := c.Entries[absPath(logFile)]
+	if !ok || e.Size != stamp.Size() || !e.ModTime.Equal(stamp.ModTime()) {
+		return FileResult{}, false
+	}
+	processed := filepath.Join(processFolder, e.Processed)
+	if _, err := os.Stat(processed); err != nil {
+		return FileResult{}, false
+	}
+	r := FileResult{
+		Input:           logFile,
+		Processed:       processed,
+		Pattern:         e.Pattern,
+		LinesRead:       e.LinesRead,
+		Entries:         e.Entries,
+		BytesRead:       e.BytesRead,
+		Earliest:        e.Earliest,
+		Latest:          e.Latest,
+		LongLines:       e.LongLines,
+		ModTimeFallback: e.Fallback,
+		endings:         lineEndings{LF: e.LF, CRLF: e.CRLF},
+	}
+	for _, pe := range e.ParseErrors {
+		r.ParseErrors = append(r.ParseErrors, ParseError{File: logFile, Line: pe.Line, Text: pe.Text, Err: errors.New(pe.Err)})
+	}
+	return r, true
+}
+
+// processCached is processLogs for Incremental runs: inputs unchanged since
+// the cached run reuse their processed file, the others are processed again,
+// and the cache is rewritten to describe exactly the current inputs.
+func (p *pipeline) processCached(logFiles []string, processFolder, delimiter string, stopOnError bool) []FileResult {
+	cache := p.loadCache(processFolder)
+	results := make([]FileResult, len(logFiles))
+	stamps := make([]os.FileInfo, len(logFiles))
+	inUse := make(map[string]bool)
+	var todo []string
+	var todoIndex []int
+	for i, logFile := range logFiles {
+		// Stat before processing, so a file changing meanwhile is seen as
+		// changed next time
+		stamps[i], _ = os.Stat(logFile)
+		if !p.opts.Force {
+			if r, ok := cache.lookup(logFile, stamps[i], processFolder); ok {
+				results[i] = r
+				inUse[filepath.Base(r.Processed)] = true
+				continue
+			}
+		}
+		todo = append(todo, logFile)
+		todoIndex = append(todoIndex, i)
+	}
+
+	// Drop the processed files of inputs that changed or are gone, so the
+	// merge only ever sees the current ones
+	for _, e := range cache.Entries {
+		if !inUse[e.Processed] {
+			os.Remove(filepath.Join(processFolder, e.Processed))
+		}
+	}
+	if p.opts.Verbose {
+		p.log.Infof("Reusing %d unchanged file(s) from the cache.", len(logFiles)-len(todo))
+	}
+
+	for j, r := range p.processLogs(todo, processFolder, delimiter, stopOnError) {
+		results[todoIndex[j]] = r
+	}
+
+	next := inputCache{Settings: p.cacheSettings(), Entries: make(map[string]cacheEntry)}
+	for i, r := range results {
+		if r.Err != nil || r.Processed == "" || stamps[i] == nil {
+			continue
+		}
+		e := cacheEntry{
+			Size:      stamps[i].Size(),
+			ModTime:   stamps[i].ModTime(),
+			Processed: filepath.Base(r.Processed),
+			Pattern:   r.Pattern,
+			LinesRead: r.LinesRead,
+			Entries:   r.Entries,
+			BytesRead: r.BytesRead,
+			Earliest:  r.Earliest,
+			Latest:    r.Latest,
+			LF:        r.endings.LF,
+			CRLF:      r.endings.CRLF,
+			LongLines: r.LongLines,
+			Fallback:  r.ModTimeFallback,
+		}
+		for _, pe := range r.ParseErrors {
+			e.ParseErrors = append(e.ParseErrors, cachedParseError{Line: pe.Line, Text: pe.Text, Err: pe.Err.Error()})
+		}
+		next.Entries[absPath(r.Input)] = e
+	}
+	data, err := json.MarshalIndent(next, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(processFolder, p.opts.Prefix+cacheFileName), data, 0644)
+	}
+	if err != nil {
+		p.log.Warnf("could not write the cache: %v", err)
+	}
+	return results
+}
+
+// absPath returns path made absolute, or path itself if that fails.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
@@ -0,0 +1,138 @@
+package logmerge
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DiffEntry is an entry that one of the files given to Diff has and the other
+// lacks.
+type DiffEntry struct {
+	Line      int       // line number of its first line
+	Timestamp time.Time // zero when it has no timestamp that parses
+	Text      string    // the entry, its lines joined with "\n"
+}
+
+// DiffResult lists the entries only found in a (OnlyA) and only in b (OnlyB),
+// each in the order of its file.
+type DiffResult struct {
+	OnlyA, OnlyB []DiffEntry
+}
+
+// Diff compares the entries of two output files, such as the final files of
+// runs before and after a configuration change. An entry starts at a line
+// with a timestamp and takes the lines without one after it. Entries are
+// compared by the instant of their timestamp and their text around it with
+// runs of white space collapsed, so a timestamp in another format or zone, a
+// different line ending or re-indented continuation lines do not make them
+// differ. Repeated entries are counted: three copies in a and two in b leave
+// one in OnlyA. Without DatePattern each file's timestamp format is detected
+// on its own; both may be gzip-compressed and in any Encoding.
+func Diff(a, b string, opts Options) (DiffResult, error) {
+	var result DiffResult
+	p, err := newPipeline(opts)
+	if err != nil {
+		return result, err
+	}
+	counts := make(map[[sha256.Size]byte]int)
+	err = p.readDiffEntries(a, func(key [sha256.Size]byte, _ DiffEntry) {
+		counts[key]++
+	})
+	if err != nil {
+		return result, err
+	}
+	matched := make(map[[sha256.Size]byte]int)
+	err = p.readDiffEntries(b, func(key [sha256.Size]byte, entry DiffEntry) {
+		if counts[key] > matched[key] {
+			matched[key]++
+		} else {
+			result.OnlyB = append(result.OnlyB, entry)
+		}
+	})
+	if err != nil {
+		return result, err
+	}
+	// The first copies of a repeated entry are the ones b has too
+	err = p.readDiffEntries(a, func(key [sha256.Size]byte, entry DiffEntry) {
+		if matched[key] > 0 {
+			matched[key]--
+		} else {
+			result.OnlyA = append(result.OnlyA, entry)
+		}
+	})
+	return result, err
+}
+
+// readDiffEntries calls fn with each entry of the file at path and the hash
+// Diff compares it by.
+func (p *pipeline) readDiffEntries(path string, fn func([sha256.Size]byte, DiffEntry)) error {
+	pattern := p.orderingPattern(p.determineDateTimePattern(path, true))
+	if pattern == "" {
+		return fmt.Errorf("unrecognized date pattern in %s", path)
+	}
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("failed to compile regex pattern: %v", err)
+	}
+	f, err := p.openInput(path)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	defer f.Close()
+
+	years := yearTracker{year: 2000}
+	var entry DiffEntry
+	var lines, words []string
+	flush := func() {
+		if len(lines) == 0 {
+			return
+		}
+		entry.Text = strings.Join(lines, "\n")
+		key := ""
+		if !entry.Timestamp.IsZero() {
+			key = entry.Timestamp.UTC().Format(time.RFC3339Nano)
+		}
+		fn(sha256.Sum256([]byte(key+"\x00"+strings.Join(words, " "))), entry)
+		lines, words = nil, nil
+	}
+	reader := lineReader{r: bufio.NewReader(f), max: int(p.opts.MaxLineBytes)}
+	for lineNumber := 1; ; lineNumber++ {
+		raw, readErr := reader.next()
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return fmt.Errorf("error reading %s line %d: %v", path, lineNumber, readErr)
+		}
+		if len(raw) == 0 && readErr != nil {
+			break
+		}
+		line := strings.TrimRight(string(raw), "\r\n")
+		text := line
+		if span := p.findTimestamp(regex, line); span != nil {
+			flush()
+			entry = DiffEntry{Line: lineNumber}
+			value := line[span[0]:span[1]]
+			if p.opts.DateLayout == "" && isYearless(value) {
+				value = fmt.Sprintf("%s%04d", yearMarker, years.next(value)) + value
+			}
+			if ts, err := parseTimestamp(value, p.opts.DateLayout); err == nil {
+				entry.Timestamp = ts
+				text = line[:span[0]] + " " + line[span[1]:]
+			}
+		} else if len(lines) == 0 {
+			// Lines before the first timestamp form an entry of their own
+			entry = DiffEntry{Line: lineNumber}
+		}
+		lines = append(lines, line)
+		words = append(words, strings.Fields(text)...)
+		if readErr != nil {
+			break
+		}
+	}
+	flush()
+	return nil
+}
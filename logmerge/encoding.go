@@ -0,0 +1,155 @@
+package logmerge
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+var (
+	utf8BOM    = []byte{0xEF, 0xBB, 0xBF}
+	utf16LEBOM = []byte{0xFF, 0xFE}
+	utf16BEBOM = []byte{0xFE, 0xFF}
+)
+
+// decodeInput returns r as UTF-8 without a byte order mark. With encoding
+// "auto" a UTF-8 or UTF-16 BOM selects the decoding and anything else is
+// read as-is; "utf8", "utf16le" and "utf16be" force one (dropping its BOM if
+// present).
+func decodeInput(r io.Reader, encoding string) io.Reader {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(3)
+	if encoding == "auto" {
+		switch {
+		case bytes.HasPrefix(head, utf8BOM):
+			encoding = "utf8"
+		case bytes.HasPrefix(head, utf16LEBOM):
+			encoding = "utf16le"
+		case bytes.HasPrefix(head, utf16BEBOM):
+			encoding = "utf16be"
+		}
+	}
+
+	switch encoding {
+	case "utf8":
+		if bytes.HasPrefix(head, utf8BOM) {
+			br.Discard(len(utf8BOM))
+		}
+	case "utf16le":
+		if bytes.HasPrefix(head, utf16LEBOM) {
+			br.Discard(len(utf16LEBOM))
+		}
+		return &utf16Reader{r: br, order: binary.LittleEndian}
+	case "utf16be":
+		if bytes.HasPrefix(head, utf16BEBOM) {
+			br.Discard(len(utf16BEBOM))
+		}
+		return &utf16Reader{r: br, order: binary.BigEndian}
+	}
+	return br
+}
+
+// utf16Reader decodes UTF-16 read from r into UTF-8. Unpaired surrogates and
+// a trailing odd byte become U+FFFD.
+type utf16Reader struct {
+	r       *bufio.Reader
+	order   binary.ByteOrder
+	pending []byte // decoded but not yet returned
+	err     error
+}
+
+func (u *utf16Reader) Read(p []byte) (int, error) {
+	for len(u.pending) == 0 {
+		if u.err != nil {
+			return 0, u.err
+		}
+		u.decode()
+	}
+	n := copy(p, u.pending)
+	u.pending = u.pending[n:]
+	return n, nil
+}
+
+// decode converts the next batch of code units into pending.
+func (u *utf16Reader) decode() {
+	var unit [2]byte
+	for i := 0; i < 2048; i++ {
+		if _, err := io.ReadFull(u.r, unit[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				u.pending = utf8.AppendRune(u.pending, utf8.RuneError)
+				err = io.EOF
+			}
+			u.err = err
+			return
+		}
+		r := rune(u.order.Uint16(unit[:]))
+		if utf16.IsSurrogate(r) {
+			// A high surrogate is only valid when a low one follows
+			decoded := utf8.RuneError
+			if next, err := u.r.Peek(2); err == nil {
+				if decoded = utf16.DecodeRune(r, rune(u.order.Uint16(next))); decoded != utf8.RuneError {
+					u.r.Discard(2)
+				}
+			}
+			r = decoded
+		}
+		u.pending = utf8.AppendRune(u.pending, r)
+	}
+}
+
+// encodeOutput returns w encoding the UTF-8 written to it as EncodingOut
+// says: "utf8" passes it through, "utf16le" and "utf16be" convert it, after a
+// byte order mark when bom is set.
+func encodeOutput(w io.Writer, encoding string, bom bool) io.Writer {
+	switch encoding {
+	case "utf16le":
+		return &utf16Writer{w: w, order: binary.LittleEndian, bom: bom}
+	case "utf16be":
+		return &utf16Writer{w: w, order: binary.BigEndian, bom: bom}
+	}
+	return w
+}
+
+// utf16Writer encodes the UTF-8 written to it as UTF-16 into w. A rune split
+// across writes is kept until its remaining bytes arrive; invalid UTF-8
+// becomes U+FFFD.
+type utf16Writer struct {
+	w       io.Writer
+	order   binary.AppendByteOrder
+	bom     bool   // a byte order mark is still to be written
+	partial []byte // start of an incomplete rune
+	buf     []byte
+}
+
+func (u *utf16Writer) Write(p []byte) (int, error) {
+	u.buf = u.buf[:0]
+	if u.bom {
+		u.bom = false
+		u.buf = u.order.AppendUint16(u.buf, 0xFEFF)
+	}
+	data := p
+	if len(u.partial) > 0 {
+		data = append(u.partial, p...)
+		u.partial = nil
+	}
+	for len(data) > 0 {
+		if !utf8.FullRune(data) {
+			u.partial = append([]byte(nil), data...)
+			break
+		}
+		r, size := utf8.DecodeRune(data)
+		data = data[size:]
+		if r1, r2 := utf16.EncodeRune(r); r1 != utf8.RuneError {
+			u.buf = u.order.AppendUint16(u.buf, uint16(r1))
+			r = r2
+		}
+		u.buf = u.order.AppendUint16(u.buf, uint16(r))
+	}
+	if _, err := u.w.Write(u.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
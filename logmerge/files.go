@@ -0,0 +1,109 @@
+package logmerge
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// minOpenFiles is the smallest MaxOpenFiles accepted: enough for the merge to
+// hold its output and read ahead, and for the on-disk sort to merge two
+// chunks.
+const minOpenFiles = 8
+
+// reservedFiles are left out of the limit derived from the operating system,
+// for stdin, stdout, stderr and the files the Go runtime keeps open.
+const reservedFiles = 16
+
+// defaultOpenFiles is the limit used when the operating system reports none.
+const defaultOpenFiles = 1024
+
+// fileBudget caps the files the pipeline has open at once (MaxOpenFiles).
+// Each user takes every file it needs in one acquire, so two users never
+// wait on files the other holds.
+type fileBudget struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	size int
+	free int
+}
+
+func newFileBudget(size int) *fileBudget {
+	b := &fileBudget{size: size, free: size}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire waits until n files, at most the whole budget, are free and takes
+// them. It returns how many it took, to be given back with release.
+func (b *fileBudget) acquire(n int) int {
+	n = min(n, b.size)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.free < n {
+		b.cond.Wait()
+	}
+	b.free -= n
+	return n
+}
+
+// release gives back n files taken by acquire.
+func (b *fileBudget) release(n int) {
+	b.mu.Lock()
+	b.free += n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// maxOpenFiles returns the MaxOpenFiles of opts, derived from the soft limit
+// of the operating system when it is 0.
+func maxOpenFiles(opts Options) int {
+	if opts.MaxOpenFiles > 0 {
+		return opts.MaxOpenFiles
+	}
+	limit := openFilesLimit()
+	if limit <= 0 {
+		return defaultOpenFiles
+	}
+	return max(limit-reservedFiles, minOpenFiles)
+}
+
+// openRetryDelay is how long openFile waits before its first retry.
+const openRetryDelay = 100 * time.Millisecond
+
+// openFile opens path like os.Open, trying again up to OpenRetries times, with
+// a doubling delay, while the error is transient.
+func (p *pipeline) openFile(path string) (*os.File, error) {
+	delay := openRetryDelay
+	for retry := 0; ; retry++ {
+		f, err := os.Open(path)
+		if err == nil || retry == p.opts.OpenRetries || !isTransient(err) {
+			return f, err
+		}
+		if p.opts.Verbose {
+			p.log.Warnf("%v; retrying in %v", err, delay)
+		}
+		select {
+		case <-time.After(delay):
+		case <-p.ctx.Done():
+			return nil, err
+		}
+		delay *= 2
+	}
+}
+
+// isTransient reports whether err, from opening a file, may go away when
+// tried again: a timeout or an error such as EAGAIN or EINTR, but never a
+// missing file or a denied permission.
+func isTransient(err error) bool {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		return false
+	}
+	var t interface {
+		Timeout() bool
+		Temporary() bool
+	}
+	return errors.As(err, &t) && (t.Timeout() || t.Temporary())
+}
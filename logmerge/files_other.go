@@ -0,0 +1,8 @@
+//go:build !unix
+
+package logmerge
+
+// openFilesLimit returns 0: only Unix systems have a limit to read.
+func openFilesLimit() int {
+	return 0
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package logmerge
+
+import "syscall"
+
+// openFilesLimit returns the soft limit on open files of the process, or 0
+// when it cannot be read.
+func openFilesLimit() int {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0
+	}
+	return int(min(limit.Cur, 1<<20))
+}
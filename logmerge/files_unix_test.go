@@ -0,0 +1,51 @@
+//go:build unix
+
+package logmerge_test
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/NL-Cristi/MergeOrderLog/logmerge"
+)
+
+func TestManyFilesWithinDescriptorLimit(t *testing.T) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		t.Skip(err)
+	}
+	lowered := limit
+	lowered.Cur = 64
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lowered); err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit) })
+
+	tests := []struct {
+		name, line string
+	}{
+		{"comma-ms", "2023-06-01 10:%02d:%02d,000 INFO entry %d\n"},
+		// Year-less: the year takes a second pass over each input
+		{"syslog", "Jun  1 10:%02d:%02d host app: entry %d\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			const files = 300 // several times the limit
+			for i := 0; i < files; i++ {
+				writeLog(t, dir, fmt.Sprintf("app-%03d.log", i), fmt.Sprintf(tt.line, i/60, i%60, i))
+			}
+			opts := logmerge.DefaultOptions(dir)
+			opts.Workers = 8
+			result, got := run(t, opts)
+			if result.Failed > 0 {
+				t.Fatalf("%d file(s) failed", result.Failed)
+			}
+			if n := strings.Count(got, "\n"); n != files {
+				t.Errorf("got %d entries, want %d", n, files)
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package logmerge
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+func (p *pipeline) formatSupport(inputFilePath, outputFilePath, dateTimePattern, delimiter string) error {
+	defer p.files.release(p.files.acquire(2))
+	inFile, err := os.Open(inputFilePath)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	defer inFile.Close()
+
+	outFile, err := createAtomic(outputFilePath)
+	if err != nil {
+		return fmt.Errorf("error creating file: %v", err)
+	}
+	defer outFile.Close()
+
+	if !p.opts.Gzip {
+		// Colors only go to a terminal, never into a stored file
+		p.color = p.opts.Color && isTerminal(outFile.File)
+		if err := p.writeFormatted(inFile, encodeOutput(outFile, p.opts.EncodingOut, true), dateTimePattern, delimiter); err != nil {
+			return err
+		}
+	} else {
+		gz, err := gzip.NewWriterLevel(outFile, p.opts.GzipLevel)
+		if err != nil {
+			return fmt.Errorf("error creating gzip writer: %v", err)
+		}
+		if err := p.writeFormatted(inFile, encodeOutput(gz, p.opts.EncodingOut, true), dateTimePattern, delimiter); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("error writing file: %v", err)
+		}
+	}
+	if err := outFile.Commit(); err != nil {
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	return nil
+}
+
+// formatPreview formats the first Preview entries of inputFilePath into
+// PreviewOut.
+func (p *pipeline) formatPreview(inputFilePath, dateTimePattern, delimiter string) error {
+	defer p.files.release(p.files.acquire(1))
+	inFile, err := os.Open(inputFilePath)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	defer inFile.Close()
+
+	reader := bufio.NewReader(inFile)
+	var head strings.Builder
+	for i := 0; i < p.opts.Preview; i++ {
+		line, err := reader.ReadString('\n')
+		head.WriteString(line)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading file: %v", err)
+		}
+	}
+	out := p.opts.PreviewOut
+	if out == nil {
+		out = io.Discard
+	}
+	p.color = p.opts.Color
+	return p.writeFormatted(strings.NewReader(head.String()), encodeOutput(out, p.opts.EncodingOut, false), dateTimePattern, delimiter)
+}
+
+// writeFormatted writes the ordered entries from r in the selected Format. It
+// stops at the first error reading r or writing w.
+func (p *pipeline) writeFormatted(r io.Reader, w io.Writer, dateTimePattern, delimiter string) error {
+	if p.opts.Collapse {
+		collapsed := p.collapseRepeats(r, dateTimePattern, delimiter)
+		defer collapsed.Close()
+		r = collapsed
+	}
+	if p.opts.Format == "json" {
+		return p.formatJSONStream(r, w, dateTimePattern, delimiter)
+	}
+	return p.formatStream(r, w, dateTimePattern, delimiter)
+}
+
+// collapseRepeats passes on the entries read from r with each run of identical
+// consecutive entries replaced as described at Options.Collapse.
+func (p *pipeline) collapseRepeats(r io.Reader, dateTimePattern, delimiter string) *io.PipeReader {
+	regex, _ := regexp.Compile(dateTimePattern)
+	pr, pw := io.Pipe()
+	go func() {
+		reader := bufio.NewReader(r)
+		writer := bufio.NewWriter(pw)
+		var entry, key string
+		count := 0
+		flush := func() {
+			if count == 0 {
+				return
+			}
+			if count > 1 {
+				header, rest, multiLine := strings.Cut(entry, delimiter)
+				entry = fmt.Sprintf("%s (repeated %d times)", header, count)
+				if multiLine {
+					entry += delimiter + rest
+				}
+			}
+			writer.WriteString(entry + "\n")
+		}
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil && !errors.Is(err, io.EOF) {
+				pw.CloseWithError(err)
+				return
+			}
+			if err != nil && line == "" {
+				break
+			}
+			line = strings.TrimRight(line, "\r\n")
+
+			lineKey := line
+			if p.opts.CollapseIgnoreTimestamp {
+				if span := p.findTimestamp(regex, line); span != nil {
+					lineKey = line[:span[0]] + line[span[1]:]
+				}
+			}
+			if count > 0 && lineKey == key {
+				count++
+			} else {
+				flush()
+				entry, key, count = line, lineKey, 1
+			}
+			if err != nil {
+				break // a last line without a newline
+			}
+		}
+		flush()
+		pw.CloseWithError(writer.Flush())
+	}()
+	return pr
+}
+
+// formatStream expands each joined entry read from r back into its original
+// lines by splitting on delimiter.
+func (p *pipeline) formatStream(r io.Reader, outFile io.Writer, dateTimePattern, delimiter string) error {
+	reader := bufio.NewReader(r)
+	regex, _ := regexp.Compile(dateTimePattern)
+	var logBuffer []string
+	writeLines := func(lines []string) error {
+		for _, l := range lines {
+			if _, err := io.WriteString(outFile, l+p.eol); err != nil {
+				return fmt.Errorf("error writing file: %v", err)
+			}
+		}
+		return nil
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("error reading line: %v", err)
+		}
+		if err != nil && line == "" {
+			break
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if span := p.findTimestamp(regex, line); span != nil {
+			if p.opts.Location != nil || p.opts.NormalizeTimestamps {
+				line = convertTimestamp(line, span, p.opts.Location, p.opts.DateLayout, p.opts.NormalizeTimestamps, tsPrecisions[p.opts.TSPrecision])
+			}
+			// Flush the buffer first
+			if err := writeLines(logBuffer); err != nil {
+				return err
+			}
+			logBuffer = nil
+			// Split the current line on continuation delimiter
+			segments := splitEntry(line, delimiter)
+			if p.color {
+				segments[0] = p.highlightLevel(segments[0])
+			}
+			if err := writeLines(segments); err != nil {
+				return err
+			}
+		} else {
+			// Accumulate in buffer; entries of the indent rule may have no
+			// timestamp but are still joined
+			logBuffer = append(logBuffer, splitEntry(line, delimiter)...)
+		}
+		if err != nil {
+			break // a last line without a newline
+		}
+	}
+
+	// Flush any remaining buffer
+	return writeLines(logBuffer)
+}
+
+// levelColors are the ANSI colors of Options.Color, by level rank.
+var levelColors = map[int]string{
+	3: "\x1b[32m", // INFO
+	4: "\x1b[33m", // WARN
+	5: "\x1b[31m", // ERROR
+	6: "\x1b[31m", // FATAL
+}
+
+// highlightLevel colors the level token of an entry's first line.
+func (p *pipeline) highlightLevel(header string) string {
+	match := p.levelRegex.FindStringSubmatchIndex(header)
+	if match == nil {
+		return header
+	}
+	start, end := match[0], match[1]
+	if len(match) > 3 && match[2] >= 0 {
+		start, end = match[2], match[3]
+	}
+	color, ok := levelColors[logLevels[strings.ToUpper(header[start:end])]]
+	if !ok {
+		return header
+	}
+	return header[:start] + color + header[start:end] + "\x1b[0m" + header[end:]
+}
+
+// jsonEntry is one line of --format json output.
+type jsonEntry struct {
+	Timestamp string `json:"timestamp,omitempty"` // RFC 3339; omitted when unparseable
+	Source    string `json:"source,omitempty"`
+	Message   string `json:"message"` // text after the timestamp, newlines restored
+	Raw       string `json:"raw"`     // the whole entry, newlines restored
+}
+
+// sourceTag matches the " [file.log]" tag processLogStream inserts after the
+// timestamp.
+var sourceTag = regexp.MustCompile(`^ \[([^\]]*)\]`)
+
+// formatJSONStream writes one JSON object per ordered entry read from r.
+func (p *pipeline) formatJSONStream(r io.Reader, w io.Writer, dateTimePattern, delimiter string) error {
+	reader := bufio.NewReader(r)
+	regex, _ := regexp.Compile(dateTimePattern)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("error reading line: %v", err)
+		}
+		if err != nil && line == "" {
+			break
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		var entry jsonEntry
+		message := line
+		if span := p.findTimestamp(regex, line); span != nil {
+			if parsed, err := parseTimestamp(line[span[0]:span[1]], p.opts.DateLayout); err == nil {
+				entry.Timestamp = parsed.Truncate(tsPrecisions[p.opts.TSPrecision]).Format(time.RFC3339Nano)
+			}
+			rest := line[span[1]:]
+			if tag := sourceTag.FindStringSubmatchIndex(rest); tag != nil {
+				entry.Source = rest[tag[2]:tag[3]]
+				if !p.opts.AnnotateSource {
+					// The tag was only added to fill the source field
+					line = line[:span[1]] + rest[tag[1]:]
+				}
+				rest = rest[tag[1]:]
+			}
+			message = strings.TrimLeft(rest, " ")
+		}
+		entry.Message = strings.Join(splitEntry(message, delimiter), "\n")
+		entry.Raw = strings.Join(splitEntry(line, delimiter), "\n")
+
+		if err := encoder.Encode(entry); err != nil {
+			return fmt.Errorf("error writing file: %v", err)
+		}
+		if err != nil {
+			break // a last line without a newline
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package logmerge_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/NL-Cristi/MergeOrderLog/logmerge"
+)
+
+func TestDelimiterInTextRoundTrips(t *testing.T) {
+	for _, delimiter := range []string{"\x00", " | ", "\\n"} {
+		// Already in order, so the output must give the input back exactly
+		input := "2023-06-01 10:00:00,000 INFO a" + delimiter + "b\n" +
+			"2023-06-01 10:00:01,000 ERROR failed" + delimiter + "\n" +
+			"\tcaused by" + delimiter + delimiter + "x\x1a\x1b\n" +
+			delimiter + "\n" +
+			"2023-06-01 10:00:02,000 INFO \x1aescape\x1b" + delimiter + "end\n"
+		opts := logmerge.DefaultOptions("")
+		opts.Delimiter = delimiter
+		var out strings.Builder
+		if err := logmerge.ProcessStream(strings.NewReader(input), &out, opts); err != nil {
+			t.Fatalf("delimiter %q: %v", delimiter, err)
+		}
+		if got := out.String(); got != input {
+			t.Errorf("delimiter %q:\ngot  %q\nwant %q", delimiter, got, input)
+		}
+	}
+}
+
+func TestBlankLinesInsideEntryRoundTrip(t *testing.T) {
+	input := "2023-06-01 10:00:00,000 ERROR failed\n" +
+		"\n" +
+		"java.lang.IllegalStateException: boom\n" +
+		"\tat com.example.Handler.run(Handler.java:42)\n" +
+		"\n" +
+		"\n" +
+		"Caused by: java.io.IOException: closed\n" +
+		"\n" +
+		"2023-06-01 10:00:01,000 INFO recovered\n"
+	for _, rule := range []string{"timestamp", "indent"} {
+		opts := logmerge.DefaultOptions("")
+		opts.ContinuationRule = rule
+		var out strings.Builder
+		if err := logmerge.ProcessStream(strings.NewReader(input), &out, opts); err != nil {
+			t.Fatalf("%s: %v", rule, err)
+		}
+		if got := out.String(); got != input {
+			t.Errorf("%s:\ngot  %q\nwant %q", rule, got, input)
+		}
+	}
+}
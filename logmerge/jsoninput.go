@@ -0,0 +1,151 @@
+package logmerge
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tsMarker encloses, in RFC 3339, the timestamp a JSONInput entry took from
+// its TSField, or a FallbackModTime entry from its file; the marked timestamp
+// starts the entry in the intermediates, so the ordering pattern finds it
+// before any other. Like yearMarker it is an escape sequence, dropped together
+// with one space after it when entries are split again.
+const tsMarker = escapeByte + "\x1d"
+
+// markedPattern matches a timestamp enclosed in tsMarkers.
+const markedPattern = `\x1a\x1d[^\x1a]*\x1a\x1d`
+
+// processJSONStream is processLogStream for JSONInput: every line is an entry
+// of its own, a JSON object ordered by its TSField. A line that is not such an
+// object is recorded as a parse error and kept with the entry before it.
+func (p *pipeline) processJSONStream(name string, r io.Reader, w io.Writer, delimiter string) (streamInfo, error) {
+	reader := lineReader{r: bufio.NewReader(r), max: int(p.opts.MaxLineBytes)}
+	var currentLogEntry string
+	var info streamInfo
+	lineNumber := 0
+
+	for {
+		if lineNumber%cancelCheckLines == 0 && p.ctx.Err() != nil {
+			return info, p.ctx.Err()
+		}
+		raw, err := reader.next()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return info, fmt.Errorf("error reading line %d: %v", lineNumber+1, err)
+		}
+		if err != nil && len(raw) == 0 {
+			break
+		}
+		line := string(raw)
+		atEOF := err != nil
+		lineNumber++
+		info.lines++
+		info.bytes += int64(len(line)) + reader.cut
+		if strings.HasSuffix(line, "\r\n") {
+			info.endings.CRLF++
+		} else if strings.HasSuffix(line, "\n") {
+			info.endings.LF++
+		}
+		if reader.cut > 0 {
+			// A truncated object no longer parses, so it is always dropped
+			info.longLines = append(info.longLines, lineNumber)
+			if atEOF {
+				break
+			}
+			continue
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if p.opts.LineTransform != nil {
+			line = p.opts.LineTransform(name, line)
+		}
+
+		if strings.TrimSpace(line) == "" {
+			// Blank lines carry nothing to order
+			if atEOF {
+				break
+			}
+			continue
+		}
+		if ts, err := p.jsonTimestamp(line); err != nil {
+			info.parseErrors = append(info.parseErrors, ParseError{File: name, Line: lineNumber, Text: line, Err: err})
+			if currentLogEntry != "" {
+				currentLogEntry += delimiter + escapeDelimiter(line, delimiter)
+			}
+		} else {
+			if currentLogEntry != "" {
+				info.entries++
+				if _, err := io.WriteString(w, currentLogEntry+"\n"); err != nil {
+					return info, fmt.Errorf("error writing output: %v", err)
+				}
+			}
+			if info.earliest.IsZero() || ts.Before(info.earliest) {
+				info.earliest = ts
+			}
+			if info.latest.IsZero() || ts.After(info.latest) {
+				info.latest = ts
+			}
+			marker := tsMarker + ts.UTC().Format(time.RFC3339Nano) + tsMarker
+			if p.opts.AnnotateSource || p.opts.Format == "json" {
+				marker += " [" + filepath.Base(name) + "] "
+			}
+			currentLogEntry = marker + escapeDelimiter(line, delimiter)
+		}
+		if atEOF {
+			break
+		}
+	}
+
+	if currentLogEntry != "" {
+		info.entries++
+		if _, err := io.WriteString(w, currentLogEntry+"\n"); err != nil {
+			return info, fmt.Errorf("error writing output: %v", err)
+		}
+	}
+	return info, nil
+}
+
+// jsonTimestamp returns the TSField timestamp of the JSON object in line. A
+// dotted TSField such as "meta.time" reaches into nested objects. The field
+// may hold a timestamp in any built-in format or a number of seconds since the
+// Unix epoch; numbers too large for seconds are read as milliseconds.
+func (p *pipeline) jsonTimestamp(line string) (time.Time, error) {
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil {
+		return time.Time{}, fmt.Errorf("not a JSON object: %v", err)
+	}
+	var value interface{} = object
+	for _, key := range strings.Split(p.opts.TSField, ".") {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return time.Time{}, fmt.Errorf("no %q field", p.opts.TSField)
+		}
+		if value, ok = fields[key]; !ok {
+			return time.Time{}, fmt.Errorf("no %q field", p.opts.TSField)
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return parseTimestamp(v, "")
+	case json.Number:
+		seconds, err := v.Float64()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if seconds >= 1e11 {
+			// Later than the year 5000 in seconds, so milliseconds
+			seconds /= 1000
+		}
+		whole, fraction := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(fraction*1e9)).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("field %q is neither a string nor a number", p.opts.TSField)
+}
@@ -0,0 +1,38 @@
+package logmerge
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Logger receives the diagnostics of a run, one message per call, by level.
+// Messages carry no trailing newline; the files listed under a warning follow
+// it on indented lines of the same message.
+type Logger interface {
+	Infof(format string, args ...any)
+	Warnf(format string, args ...any)
+	Errorf(format string, args ...any)
+}
+
+// TextLogger returns a Logger writing each message to w as text, after
+// "Warning: " or "Error: " for those levels. Its methods may be called
+// concurrently.
+func TextLogger(w io.Writer) Logger {
+	return &textLogger{w: w}
+}
+
+type textLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *textLogger) Infof(format string, args ...any)  { l.printf("", format, args...) }
+func (l *textLogger) Warnf(format string, args ...any)  { l.printf("Warning: ", format, args...) }
+func (l *textLogger) Errorf(format string, args ...any) { l.printf("Error: ", format, args...) }
+
+func (l *textLogger) printf(prefix, format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintln(l.w, prefix+fmt.Sprintf(format, args...))
+}
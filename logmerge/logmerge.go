@@ -0,0 +1,1545 @@
+// Package logmerge merges the log files found under a directory into a single
+// file ordered by timestamp. Multi-line entries (stack traces and the like)
+// are kept together: every line without a timestamp travels with the entry
+// before it.
+//
+// The pipeline runs in four steps, each leaving a file in the ProcessedLogs
+// folder: every input is processed (entries joined into single lines), the
+// results are merged, the merged file is ordered and the ordered entries are
+// formatted back into their original lines.
+package logmerge
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProcessedLogsFolderName is the output folder created inside ParentFolder
+// (or OutputDir).
+const ProcessedLogsFolderName = "ProcessedLogs"
+
+// DefaultLevelPattern locates the level token searched by Options.Level.
+const DefaultLevelPattern = `\b(TRACE|DEBUG|INFO|WARN(?:ING)?|ERROR|FATAL)\b`
+
+// Options configures a run. Start from DefaultOptions: several zero values
+// (Delimiter, Workers, DetectLines) are rejected. The related command-line
+// flag is noted where the name differs.
+type Options struct {
+	// ParentFolder is searched for input files, including its
+	// subfolders when Recursive is set. ExtraFolders are searched the same
+	// way, after it, and their files join the same output.
+	ParentFolder string
+	ExtraFolders []string
+	Recursive    bool
+	// MaxDepth limits how many folder levels below each searched folder a
+	// recursive search enters; 1 reads only its direct subfolders. 0 is
+	// unlimited.
+	MaxDepth int
+	// Include/Exclude are globs matched against base file names; a file must
+	// match an include pattern (when any are given) and no exclude pattern.
+	Include, Exclude []string
+	// Rotated treats numbered rotations of a file (app.log.2, app.log.1,
+	// app.log) as one stream: they are merged oldest first, and that order
+	// breaks ties between equal timestamps.
+	Rotated bool
+	// Extensions lists the input file extensions, without the dot (--ext).
+	// Rotated copies (app.log.1) and .gz files are picked up as well.
+	Extensions []string
+	// Files, when set, are the inputs, merged in this order, instead of the
+	// files found in the folders (--files-from). The folder search, the name
+	// filters and Rotated do not apply, and ParentFolder only locates the
+	// ProcessedLogs folder when OutputDir is "".
+	Files []string
+
+	// Output is the path of the final file; "" uses FINAL_FORMATTED.log (or
+	// .jsonl) in the ProcessedLogs folder. A path such as /dev/stdout or
+	// /dev/fd/3, naming an open descriptor, or an existing file that is not a
+	// regular one, such as a named pipe, is written as a stream: directly
+	// rather than renamed into place, without a ".gz" suffix added, and with
+	// the manifest kept in the ProcessedLogs folder.
+	Output string
+	// OutputDir is the folder the ProcessedLogs folder is created in; ""
+	// uses ParentFolder.
+	OutputDir string
+	// WorkDir, when set, is used as the ProcessedLogs folder itself, created
+	// with its parents if missing, in place of OutputDir/ProcessedLogs. The
+	// intermediates, the default output, the manifest and the Incremental
+	// cache all go there, so with an Output elsewhere too nothing is written
+	// under ParentFolder, e.g. for a read-only source mount.
+	WorkDir string
+	// Prefix is prepended to the name of every file the run creates in the
+	// ProcessedLogs folder (incident123-MERGED.log, ...), including the
+	// manifest and the Incremental cache, so runs sharing the folder keep
+	// apart. It must not contain a path separator.
+	Prefix string
+	// Delimiter joins the lines of a multi-line entry internally. Where it
+	// occurs in the logs themselves it is escaped in the intermediates and
+	// restored in the final file. It must not contain \x1a or \x1b, which
+	// the escaping uses.
+	Delimiter string
+
+	// DateLayout and DatePattern, when both set, replace timestamp detection:
+	// DatePattern is a regex finding the timestamp and DateLayout the Go time
+	// layout parsing it.
+	DateLayout, DatePattern string
+	// LineTransform, when set, rewrites every line of an input (without its
+	// line ending) before it is parsed and written, e.g. to redact personal
+	// data. source is the input path ("stdin" for ProcessStream). It is
+	// called from several workers at once, so it must be safe for
+	// concurrent use, and it should leave timestamps intact.
+	LineTransform func(source, line string) string
+	// Encoding is the input text encoding: "auto" (UTF-8, or UTF-16 when
+	// the file starts with its byte order mark), "utf8", "utf16le" or
+	// "utf16be". Inputs are decoded to UTF-8 and any BOM is dropped.
+	Encoding string
+	// EncodingOut is the encoding of the final output: "utf8" or, for tools
+	// that need it, "utf16le" or "utf16be", written after a byte order mark.
+	// Only the final write is converted; MERGED, MERGED_ORDERED and the
+	// processed files are always UTF-8, and nothing is written with a UTF-8
+	// BOM.
+	EncodingOut string
+	// ContinuationRule decides which lines belong to the entry before them:
+	// "timestamp" joins every line without a timestamp, "indent" every line
+	// starting with a space or tab (and blank lines). With "indent" an
+	// unindented line always starts an entry, with the previous entry's time
+	// if it has no timestamp of its own.
+	ContinuationRule string
+	// AssumeYear is the year of the last year-less timestamp (e.g. the syslog
+	// "Jun 01 12:34:56") in each file; earlier ones move back a year at each
+	// December to January wrap. 0 is the current year (--assume-year).
+	AssumeYear int
+	// JSONInput reads every input as JSON lines, one object per entry,
+	// ordered by the timestamp in the field named TSField (--json-input,
+	// --ts-field). Lines that are not such objects are reported as parse
+	// errors. DatePattern and DateLayout do not apply.
+	JSONInput bool
+	TSField   string
+	// FallbackModTime keeps an input in which no timestamp can be found or
+	// parsed instead of failing it: each of its lines becomes an entry at
+	// the file's modification time plus the line's index in nanoseconds, so
+	// the file keeps its own order and sorts among the entries logged when
+	// it was last written. JSONInput and ProcessStream ignore it.
+	FallbackModTime bool
+	// Formats names the built-in timestamp formats detection tries, in
+	// priority order: "comma-ms" (2023-06-01 12:34:56,789), "dot-ms"
+	// (2023-06-01 12:34:56.789), "iso8601" (2023-06-01T12:34:56.789Z) and
+	// "syslog" (Jun 01 12:34:56). nil tries them all, in that order. Leaving
+	// a format out keeps it from matching anywhere, e.g. in message text.
+	Formats []string
+	// MixedFormats lets a timestamp in any of the active Formats start an
+	// entry in every line of an input, for files concatenating logs of
+	// services that use different formats. By default only the format
+	// detected at the top of a file does, and lines with another one are
+	// taken as continuation lines. Each line is tried against the formats in
+	// priority order, and the first one that matches and parses gives its
+	// timestamp; ordering always accepts every active format. With syslog
+	// active it takes an extra pass over each input to find the year. It
+	// cannot be combined with DatePattern.
+	MixedFormats bool
+	// Anchor only accepts a timestamp at the very start of a line, for the
+	// built-in formats and DatePattern alike, so a date quoted inside a
+	// message never starts an entry.
+	Anchor bool
+	// DetectLines is how many non-blank lines are scanned for a timestamp
+	// before a file is considered unrecognized (--detect-lines).
+	DetectLines int
+
+	// From/To drop entries outside this time window; a zero value leaves
+	// that side open. Without From, Since opens the window that long before
+	// the run: a timestamp with a UTC offset is compared with the current
+	// time, and one without (read as UTC) with this host's wall clock, so
+	// the logs written here in local time match. KeepUnparsed keeps lines
+	// without a timestamp when the entry before them is kept
+	// (--keep-unparsed).
+	From, To     time.Time
+	Since        time.Duration
+	KeepUnparsed bool
+	// Level keeps only entries at or above this severity (TRACE, DEBUG, INFO,
+	// WARN, ERROR or FATAL); "" keeps everything. LevelRegex locates the
+	// level in an entry's first line; group 1 is used if present.
+	Level, LevelRegex string
+
+	// NoSort skips ordering: the final file keeps the merged file-then-line
+	// order, e.g. when clock skew between hosts makes a sort misleading. The
+	// filters below depend on ordering and cannot be combined with it.
+	NoSort bool
+	// Reverse orders the entries newest first.
+	Reverse bool
+	// Tail, when positive, keeps only the Tail most recent entries, after
+	// all other filters. A multi-line entry counts once.
+	Tail int
+	// Preview, when positive, formats the first Preview entries of the
+	// ordered output into PreviewOut (nil discards them) instead of writing
+	// the final file and the manifest, for a quick look at how a new log
+	// source is detected and ordered. Everything is still processed and
+	// ordered; Output, Gzip, Bucket and SplitOutputs are ignored.
+	Preview    int
+	PreviewOut io.Writer
+
+	// Color highlights level tokens (ERROR and FATAL red, WARN yellow, INFO
+	// green) with ANSI codes in text output. Process and Format only do so
+	// when the output file is a terminal, so stored logs stay clean;
+	// ProcessStream cannot tell, and the caller should only set it for one.
+	Color bool
+	// Location, when set, is the zone timestamps are rewritten to in the
+	// final file (--tz). Sorting always uses the absolute instant.
+	Location *time.Location
+	// NormalizeTimestamps rewrites the timestamp of each entry in the final
+	// text file in RFC 3339 (2023-06-01T12:34:56.789+02:00), in Location when
+	// set; one without an offset is taken as UTC. Only the matched timestamp
+	// changes, and entries whose timestamp cannot be parsed are kept as is.
+	NormalizeTimestamps bool
+	// TSPrecision truncates the timestamps NormalizeTimestamps writes, those
+	// of Format "json" and those Bucket files entries by, to ns, us, ms or s;
+	// "" keeps them whole. Ordering always uses the full precision.
+	TSPrecision string
+	// AnnotateSource inserts the source file name after each timestamp.
+	AnnotateSource bool
+	// Dedup drops entries identical to the one right before them after
+	// sorting; DedupIgnoreSource compares them without the source tag.
+	Dedup, DedupIgnoreSource bool
+	// DedupGlobal drops every repeat of an entry (timestamp and message,
+	// ignoring the source tag), wherever it appears. It keeps a hash of each
+	// distinct entry in memory, so use it only when Dedup is not enough.
+	DedupGlobal bool
+	// Collapse replaces each run of identical consecutive entries in the final
+	// file with its first entry, marked " (repeated N times)" at the end of
+	// its first line, N counting the whole run. CollapseIgnoreTimestamp
+	// compares entries without their timestamp. Unlike Dedup this only
+	// changes how the output reads, and the run is not counted in Stats.
+	Collapse, CollapseIgnoreTimestamp bool
+	// EOL is the line ending of the final file: "auto" (the ending most input
+	// lines use), "lf" or "crlf".
+	EOL string
+	// Format selects the final writer: "text" or "json" (one object per entry).
+	Format string
+	// Gzip compresses the final file with GzipLevel; ".gz" is appended to
+	// its name.
+	Gzip      bool
+	GzipLevel int
+	// Bucket splits the final file by the time of its entries: "hour" or
+	// "day" writes FINAL_FORMATTED-2023-06-01-12.log (or -2023-06-01) style
+	// files next to Output instead of Output itself, and entries without a
+	// parseable timestamp go to FINAL_FORMATTED-unknown.log. "" writes one
+	// file. Location, when set, decides the bucket boundaries.
+	Bucket string
+
+	// MaxLineBytes, when positive, limits the length of an input line, not
+	// counting its line ending, so a single runaway line cannot exhaust
+	// memory. Longer lines are cut to the limit while they are read and
+	// then truncated or dropped as LongLines says ("truncate" or "drop";
+	// JSONInput lines are always dropped). They are listed in
+	// FileResult.LongLines and counted in Result.LongLines.
+	MaxLineBytes int64
+	LongLines    string
+
+	// MaxMemory is the merged size in bytes above which ordering spills
+	// sorted chunks to disk; 0 always sorts in memory (--max-memory).
+	MaxMemory int64
+	// TmpDir holds the chunks spilled by the on-disk sort; "" uses a
+	// sort-tmp folder next to the ordered file (so in ProcessedLogs). The
+	// chunks are removed when ordering ends, whether or not it succeeded.
+	TmpDir string
+	// Workers is the number of files processed concurrently.
+	Workers int
+	// MaxOpenFiles caps the files open at once across all steps, whatever
+	// Workers is: workers wait for files to be free, the on-disk sort
+	// merges its chunks in several passes and SplitOutputs closes and
+	// later reopens stream files. 0 derives it from the operating system's
+	// soft limit; otherwise it must be at least 8.
+	MaxOpenFiles int
+	// OpenRetries is how many more times opening an input is tried after a
+	// transient error, such as EAGAIN or a timeout on a network filesystem,
+	// waiting 100ms before the first retry and twice as long before each
+	// next one. An input that does not exist or may not be read fails at
+	// once.
+	OpenRetries int
+	// Strict aborts the run, without output, if any file fails.
+	Strict bool
+	// SkipEmpty skips inputs that are empty or hold only whitespace, such as
+	// rotation placeholders, instead of failing them for having no date
+	// pattern. They are counted in Result.SkippedEmpty.
+	SkipEmpty bool
+	// StrictTimestamps aborts the run if a timestamp matches the date pattern
+	// but cannot be parsed. Otherwise such lines are reported and sorted with
+	// the entry before them.
+	StrictTimestamps bool
+	// SkewThreshold, when positive, warns about inputs whose time ranges
+	// overlap another input's by more than this, a sign of clock skew
+	// between hosts (--skew-threshold). It never changes the output.
+	SkewThreshold time.Duration
+	// OnCollision decides what happens to inputs in different folders that
+	// share a file name: "rename" processes them all (app.log, app1.log, ...),
+	// "skip" keeps only the first one found and "error" fails the run.
+	OnCollision string
+
+	// PerFileOutput, when set, is a folder that receives a copy of every
+	// processed file: its input with each multi-line entry joined into one
+	// line, as the process step writes it. NoMerge then ends the run there,
+	// without merging, ordering or formatting, and Result.Output stays "".
+	PerFileOutput string
+	NoMerge       bool
+	// SplitBy, when set, is a regex whose first capture group names the
+	// stream an entry belongs to, matched against the entry's first line;
+	// e.g. `\[(\w+)\]` routes "[auth]" and "[db]" entries apart. Each
+	// processed file is split into one file per stream before merging:
+	// app.log gives app-auth.log, app-db.log and, for the entries without a
+	// match, app-unmatched.log. SplitOutputs then also writes one final file
+	// per stream, FINAL_FORMATTED-auth.log and so on, listed in
+	// Result.Buckets. SplitBy cannot be combined with Incremental, nor
+	// SplitOutputs with Bucket.
+	SplitBy      string
+	SplitOutputs bool
+
+	// TiebreakRegex, when set, is a regex whose first capture group, found
+	// in an entry's first line (e.g. `req=(\S+)`), orders entries with equal
+	// timestamps. Entries are compared by timestamp first; on a tie those
+	// with a capture come before those without, captures are compared
+	// byte by byte (in ascending order even with Reverse), and what is
+	// still equal keeps its merged order. An entry without a timestamp of
+	// its own takes the capture of the entry before it along with its
+	// timestamp, so it stays right after it.
+	TiebreakRegex string
+
+	// PreserveUnparsedPosition keeps every entry without a timestamp of its
+	// own at its position in the merged stream, counted among the entries
+	// the time window and Level keep, and sorts only the others into the
+	// remaining positions; Dedup and Tail then apply to the result. By
+	// default such an entry takes the timestamp of the entry before it, so
+	// the entries at the start of a file before its first timestamp sort
+	// to the very top.
+	PreserveUnparsedPosition bool
+
+	// ShowAllWarnings prints a warning for every line ordering cannot find
+	// a timestamp in; by default only the first 10 are shown, followed by
+	// a count of the others.
+	ShowAllWarnings bool
+
+	// SortFiles orders the inputs found in the folders: "name" (by base
+	// name), "modtime" (newest first) or "size" (largest first); "" keeps
+	// the search order. LimitFiles, when positive, then keeps only the first
+	// that many, e.g. to try a run on a sample of a large folder. Neither
+	// applies to Files.
+	SortFiles  string
+	LimitFiles int
+
+	// KeepIntermediate keeps every file in the ProcessedLogs folder. Keep
+	// names the intermediates retained otherwise: "merged", "ordered" and/or
+	// "processed".
+	KeepIntermediate bool
+	Keep             []string
+	// Incremental keeps the processed files together with a cache
+	// (ProcessedLogs/.cache.json) of each input's size and modification
+	// time, and reuses them for inputs that did not change since. Force
+	// processes every input again anyway, e.g. after changing a
+	// LineTransform, which the cache cannot compare.
+	Incremental, Force bool
+
+	// Log receives diagnostics by level (see TextLogger); nil discards them.
+	// Verbose adds a message after each step. Progress, when set, receives a
+	// "processed N/M" counter.
+	Log      Logger
+	Verbose  bool
+	Progress io.Writer
+}
+
+// DefaultOptions returns the options used by the command line tool when no
+// flags are given, for ParentFolder.
+func DefaultOptions(parentFolder string) Options {
+	return Options{
+		ParentFolder:     parentFolder,
+		Recursive:        true,
+		Delimiter:        "\x00",
+		DetectLines:      100,
+		ContinuationRule: "timestamp",
+		TSField:          "ts",
+		KeepUnparsed:     true,
+		Extensions:       []string{"log"},
+		LevelRegex:       DefaultLevelPattern,
+		EOL:              "auto",
+		Encoding:         "auto",
+		EncodingOut:      "utf8",
+		Format:           "text",
+		GzipLevel:        gzip.DefaultCompression,
+		LongLines:        "truncate",
+		MaxMemory:        1 << 30,
+		Workers:          runtime.NumCPU(),
+		OnCollision:      "rename",
+		OpenRetries:      3,
+	}
+}
+
+// Result describes a completed run.
+type Result struct {
+	// Output is the path of the final file. With Bucket or SplitOutputs it
+	// is only the name the files of each bucket or stream are derived from,
+	// and Buckets lists them.
+	Output  string
+	Buckets []string
+	// PerFile lists the copies written to PerFileOutput, in merge order.
+	PerFile []string
+	// Files holds one result per input file, in merge order.
+	Files []FileResult
+	// Failed counts the inputs that could not be processed; they are left
+	// out of Output.
+	Failed int
+	// SkippedEmpty counts the inputs left out because they were empty
+	// (SkipEmpty).
+	SkippedEmpty int
+	// Skipped lists every input left out, whether by the search, the
+	// filters or a failure, with the reason; SkippedReport is where it was
+	// written (skipped.json in the ProcessedLogs folder).
+	Skipped       []SkippedFile
+	SkippedReport string
+	// ParseErrors counts the lines whose timestamp could not be parsed; they
+	// are listed in ParseErrorReport (parse-errors.log in ProcessedLogs).
+	ParseErrors      int
+	ParseErrorReport string
+	// LongLines counts the input lines longer than MaxLineBytes.
+	LongLines int
+	// Manifest is the path of manifest.json, which records every input
+	// and whether it was used.
+	Manifest string
+	Stats    Stats
+}
+
+// Stats summarizes a run.
+type Stats struct {
+	InputFiles int
+	InputBytes int64 // on-disk size, so compressed for .gz inputs
+	// Entries counts the entries written after all filters; Earliest and
+	// Latest are their extreme timestamps (zero if none could be parsed).
+	// They are collected while ordering, so they stay zero with NoSort.
+	Entries          int
+	Earliest, Latest time.Time
+	// Wall-clock time spent in each step.
+	Process, Merge, Order, Format time.Duration
+}
+
+// observe accounts for an entry written by the ordering step.
+func (s *Stats) observe(line logLine) {
+	s.Entries++
+	if line.Timestamp.IsZero() {
+		return
+	}
+	if s.Earliest.IsZero() || line.Timestamp.Before(s.Earliest) {
+		s.Earliest = line.Timestamp
+	}
+	if s.Latest.IsZero() || line.Timestamp.After(s.Latest) {
+		s.Latest = line.Timestamp
+	}
+}
+
+var (
+	// ErrNoLogFiles is returned when the searched folders hold no matching
+	// files.
+	ErrNoLogFiles = errors.New("no .log files found in the specified directory or its subdirectories")
+	// ErrAborted is returned when Strict is set and a file failed; no output
+	// is written.
+	ErrAborted = errors.New("a file could not be processed and strict mode is set")
+	// ErrMalformedTimestamp is wrapped by the error returned when
+	// StrictTimestamps is set and a timestamp could not be parsed.
+	ErrMalformedTimestamp = errors.New("malformed timestamp")
+	// ErrUnordered is wrapped by the error Validate returns for a file that
+	// is not in timestamp order.
+	ErrUnordered = errors.New("not in timestamp order")
+)
+
+// pipeline is one run with validated options and the state derived from them.
+type pipeline struct {
+	ctx        context.Context
+	opts       Options
+	log        Logger
+	minLevel   int
+	levelRegex *regexp.Regexp
+	fileRegex  *regexp.Regexp // matches the base names of input files
+	eol        string         // resolved terminator for the final file; intermediates use "\n"
+	color      bool           // highlight levels in the text written by formatStream
+	stats      Stats
+	formats    []timestampFormat
+	splitRegex *regexp.Regexp // nil without SplitBy
+	tiebreak   *regexp.Regexp // nil without TiebreakRegex
+	files      *fileBudget
+	skipped    []SkippedFile    // inputs left out so far, in Result.Skipped
+	since      time.Time        // start of the Since window; zero without one
+	mixed      []*regexp.Regexp // MixedFormats: the pattern of each format, in priority order
+}
+
+func newPipeline(opts Options) (*pipeline, error) {
+	p := &pipeline{ctx: context.Background(), opts: opts, log: opts.Log, eol: "\n"}
+	if p.log == nil {
+		p.log = TextLogger(io.Discard)
+	}
+	if err := validateCustomDateFormat(opts.DateLayout, opts.DatePattern); err != nil {
+		return nil, err
+	}
+	if opts.Delimiter == "" {
+		return nil, errors.New("--delimiter must not be empty")
+	}
+	if strings.ContainsAny(opts.Delimiter, yearMarker+escapedDelimiter) {
+		return nil, errors.New("--delimiter must not contain \\x1a, \\x1b or \\x1c")
+	}
+	if opts.JSONInput && opts.DatePattern != "" {
+		return nil, errors.New("--json-input cannot be combined with --datePattern/--dateLayout")
+	}
+	if opts.JSONInput && opts.TSField == "" {
+		return nil, errors.New("--ts-field must not be empty")
+	}
+	if opts.AssumeYear < 0 || opts.AssumeYear > 9999 {
+		return nil, fmt.Errorf("--assume-year must be between 1 and 9999, got %d", opts.AssumeYear)
+	}
+	if opts.AssumeYear == 0 {
+		p.opts.AssumeYear = time.Now().Year()
+	}
+	// A year-less --from/--to parses with year 0
+	if opts.Since > 0 && opts.From.IsZero() {
+		p.since = time.Now().Add(-opts.Since)
+	}
+	if p.opts.From.Year() == 0 {
+		p.opts.From = p.opts.From.AddDate(p.opts.AssumeYear, 0, 0)
+	}
+	if p.opts.To.Year() == 0 {
+		p.opts.To = p.opts.To.AddDate(p.opts.AssumeYear, 0, 0)
+	}
+	if opts.GzipLevel < gzip.HuffmanOnly || opts.GzipLevel > gzip.BestCompression {
+		return nil, fmt.Errorf("--gzip-level must be between %d and %d, got %d", gzip.HuffmanOnly, gzip.BestCompression, opts.GzipLevel)
+	}
+	if opts.Level != "" {
+		if p.minLevel = logLevels[strings.ToUpper(opts.Level)]; p.minLevel == 0 {
+			return nil, fmt.Errorf("unknown --level %q; use TRACE, DEBUG, INFO, WARN, ERROR or FATAL", opts.Level)
+		}
+	}
+	var err error
+	if p.levelRegex, err = regexp.Compile(opts.LevelRegex); err != nil {
+		return nil, fmt.Errorf("invalid --level-regex %q: %v", opts.LevelRegex, err)
+	}
+	if p.fileRegex, err = extensionsRegex(opts.Extensions); err != nil {
+		return nil, err
+	}
+	if p.formats, err = selectFormats(opts.Formats); err != nil {
+		return nil, err
+	}
+	if opts.SplitBy != "" {
+		if p.splitRegex, err = regexp.Compile(opts.SplitBy); err != nil {
+			return nil, fmt.Errorf("invalid --split-by-regex %q: %v", opts.SplitBy, err)
+		}
+		if p.splitRegex.NumSubexp() == 0 {
+			return nil, fmt.Errorf("--split-by-regex %q must have a capture group naming the stream", opts.SplitBy)
+		}
+		if opts.Incremental {
+			return nil, errors.New("--split-by-regex cannot be combined with --incremental")
+		}
+	}
+	if opts.TiebreakRegex != "" {
+		if p.tiebreak, err = regexp.Compile(opts.TiebreakRegex); err != nil {
+			return nil, fmt.Errorf("invalid --tiebreak-regex %q: %v", opts.TiebreakRegex, err)
+		}
+		if p.tiebreak.NumSubexp() == 0 {
+			return nil, fmt.Errorf("--tiebreak-regex %q must have a capture group", opts.TiebreakRegex)
+		}
+	}
+	if opts.SplitOutputs && (opts.SplitBy == "" || opts.Bucket != "") {
+		return nil, errors.New("--split-outputs requires --split-by-regex and cannot be combined with --bucket")
+	}
+	if (opts.Bucket != "" || opts.SplitOutputs) && opts.Output != "" && isStream(opts.Output) {
+		return nil, fmt.Errorf("--output %s is a stream and cannot be used with --bucket or --split-outputs, which name files after it", opts.Output)
+	}
+	for _, pattern := range append(append([]string{}, opts.Include...), opts.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %v", pattern, err)
+		}
+	}
+	for _, name := range opts.Keep {
+		if name != "merged" && name != "ordered" && name != "processed" {
+			return nil, fmt.Errorf("unknown --keep value %q; use merged, ordered or processed", name)
+		}
+	}
+	if opts.Encoding != "auto" && opts.Encoding != "utf8" && opts.Encoding != "utf16le" && opts.Encoding != "utf16be" {
+		return nil, fmt.Errorf("--encoding must be auto, utf8, utf16le or utf16be, got %q", opts.Encoding)
+	}
+	if opts.SortFiles != "" && opts.SortFiles != "name" && opts.SortFiles != "modtime" && opts.SortFiles != "size" {
+		return nil, fmt.Errorf("--sort-files must be name, modtime or size, got %q", opts.SortFiles)
+	}
+	if opts.LimitFiles < 0 {
+		return nil, fmt.Errorf("--limit-files must not be negative, got %d", opts.LimitFiles)
+	}
+	if opts.NoMerge && opts.PerFileOutput == "" {
+		return nil, errors.New("--no-merge requires --per-file-output")
+	}
+	if opts.MaxLineBytes < 0 {
+		return nil, fmt.Errorf("--max-line-bytes must not be negative, got %d", opts.MaxLineBytes)
+	}
+	if opts.LongLines != "truncate" && opts.LongLines != "drop" {
+		return nil, fmt.Errorf("--long-lines must be truncate or drop, got %q", opts.LongLines)
+	}
+	if opts.EncodingOut != "utf8" && opts.EncodingOut != "utf16le" && opts.EncodingOut != "utf16be" {
+		return nil, fmt.Errorf("--encoding-out must be utf8, utf16le or utf16be, got %q", opts.EncodingOut)
+	}
+	if opts.EOL != "auto" && opts.EOL != "lf" && opts.EOL != "crlf" {
+		return nil, fmt.Errorf("--eol must be auto, lf or crlf, got %q", opts.EOL)
+	}
+	if opts.Format != "text" && opts.Format != "json" {
+		return nil, fmt.Errorf("--format must be text or json, got %q", opts.Format)
+	}
+	if opts.MixedFormats && opts.DatePattern != "" {
+		return nil, errors.New("--mixed-formats cannot be combined with --datePattern")
+	}
+	if opts.MixedFormats {
+		for _, pattern := range p.formatPatterns() {
+			p.mixed = append(p.mixed, regexp.MustCompile(p.anchored(pattern)))
+		}
+	}
+	if opts.Bucket != "" && bucketLayouts[opts.Bucket] == "" {
+		return nil, fmt.Errorf("--bucket must be hour or day, got %q", opts.Bucket)
+	}
+	if opts.TSPrecision != "" && tsPrecisions[opts.TSPrecision] == 0 {
+		return nil, fmt.Errorf("--ts-precision must be ns, us, ms or s, got %q", opts.TSPrecision)
+	}
+	if opts.ContinuationRule != "timestamp" && opts.ContinuationRule != "indent" {
+		return nil, fmt.Errorf("--continuation-rule must be timestamp or indent, got %q", opts.ContinuationRule)
+	}
+	if opts.OnCollision != "rename" && opts.OnCollision != "skip" && opts.OnCollision != "error" {
+		return nil, fmt.Errorf("--on-collision must be rename, skip or error, got %q", opts.OnCollision)
+	}
+	if strings.ContainsAny(opts.Prefix, `/\`) {
+		return nil, fmt.Errorf("--prefix must not contain a path separator, got %q", opts.Prefix)
+	}
+	if len(opts.Files) > 0 && opts.ParentFolder == "" && opts.OutputDir == "" && opts.WorkDir == "" {
+		return nil, errors.New("--output-dir or --work-dir is required with --files-from and no --parentFolder")
+	}
+	if opts.MaxDepth < 0 {
+		return nil, fmt.Errorf("--max-depth must not be negative, got %d", opts.MaxDepth)
+	}
+	if opts.NoSort && (opts.Reverse || opts.Tail > 0 || opts.Dedup || opts.DedupGlobal || opts.Level != "" || !opts.From.IsZero() || !opts.To.IsZero() || opts.Since > 0) {
+		return nil, errors.New("--no-sort cannot be combined with --reverse, --tail, --dedup, --dedup-global, --level or --from/--to")
+	}
+	if opts.SkewThreshold < 0 {
+		return nil, fmt.Errorf("--skew-threshold must not be negative, got %v", opts.SkewThreshold)
+	}
+	if opts.Tail < 0 {
+		return nil, fmt.Errorf("--tail must not be negative, got %d", opts.Tail)
+	}
+	if opts.Preview < 0 {
+		return nil, fmt.Errorf("--preview must not be negative, got %d", opts.Preview)
+	}
+	if opts.DetectLines < 1 {
+		return nil, fmt.Errorf("--detect-lines must be at least 1, got %d", opts.DetectLines)
+	}
+	if opts.Workers < 1 {
+		return nil, fmt.Errorf("--workers must be at least 1, got %d", opts.Workers)
+	}
+	if opts.OpenRetries < 0 {
+		return nil, fmt.Errorf("--open-retries must not be negative, got %d", opts.OpenRetries)
+	}
+	if opts.MaxOpenFiles < 0 || opts.MaxOpenFiles > 0 && opts.MaxOpenFiles < minOpenFiles {
+		return nil, fmt.Errorf("--max-open-files must be 0 or at least %d, got %d", minOpenFiles, opts.MaxOpenFiles)
+	}
+	p.files = newFileBudget(maxOpenFiles(opts))
+	return p, nil
+}
+
+// Process runs the whole pipeline over opts.ParentFolder, or opts.Files. Files
+// that cannot be processed are reported in the Result and left out of the
+// output unless Strict is set, in which case ErrAborted is returned.
+func Process(opts Options) (Result, error) {
+	return ProcessContext(context.Background(), opts)
+}
+
+// ProcessContext is Process with cancellation. Once ctx is done no new file is
+// started, the files written so far (including partial ones) are removed and
+// ctx.Err() is returned.
+func ProcessContext(ctx context.Context, opts Options) (Result, error) {
+	p, err := newPipeline(opts)
+	if err != nil {
+		return Result{}, err
+	}
+	p.ctx = ctx
+	return p.run()
+}
+
+func (p *pipeline) run() (Result, error) {
+	// Gather .log files
+	allLogs, err := p.inputFiles()
+	if err != nil {
+		return Result{}, err
+	}
+	if len(allLogs) == 0 {
+		return Result{}, ErrNoLogFiles
+	}
+
+	// Make sure the final destination can be written to before doing any work
+	if p.opts.Output != "" {
+		if err := os.MkdirAll(filepath.Dir(p.opts.Output), os.ModePerm); err != nil {
+			return Result{}, fmt.Errorf("error creating output directory for '%s': %v", p.opts.Output, err)
+		}
+	}
+
+	// Create or verify ProcessedLogs folder
+	processFolder, err := p.createProcessedLogsFolder(processedLogsPath(p.opts))
+	if err != nil {
+		return Result{}, err
+	}
+
+	// Process logs in parallel
+	p.stats.InputFiles = len(allLogs)
+	for _, logFile := range allLogs {
+		if info, err := os.Stat(logFile); err == nil {
+			p.stats.InputBytes += info.Size()
+		}
+	}
+	delimiter := p.opts.Delimiter
+	started := time.Now()
+	var result Result
+	if p.opts.Incremental {
+		result.Files = p.processCached(allLogs, processFolder, delimiter, p.opts.Strict)
+	} else {
+		result.Files = p.processLogs(allLogs, processFolder, delimiter, p.opts.Strict)
+	}
+	p.stats.Process = time.Since(started)
+	var processedLogFiles []string
+	var endings lineEndings
+	for _, file := range result.Files {
+		if file.Err != nil {
+			if p.ctx.Err() == nil {
+				p.log.Errorf("%v", file.Err)
+			}
+			result.Failed++
+			p.skipFailed(file)
+		} else if file.Empty {
+			result.SkippedEmpty++
+			p.skip(file.Input, SkipEmpty, nil)
+		} else if file.Processed != "" {
+			processedLogFiles = append(processedLogFiles, file.Processed)
+		}
+		endings.add(file.endings)
+	}
+	result.Skipped = p.skipped
+	p.eol = chooseEOL(p.opts.EOL, endings)
+	p.reportSkew(result.Files)
+	if err := p.ctx.Err(); err != nil {
+		removeFiles(processedLogFiles)
+		return result, err
+	}
+	if p.opts.Strict && result.Failed > 0 {
+		removeFiles(processedLogFiles)
+		return result, ErrAborted
+	}
+
+	// Report timestamps that matched the pattern but could not be parsed
+	var parseErrors []ParseError
+	for _, file := range result.Files {
+		if file.Err == nil {
+			parseErrors = append(parseErrors, file.ParseErrors...)
+		}
+	}
+	result.ParseErrors = len(parseErrors)
+	if len(parseErrors) > 0 {
+		result.ParseErrorReport = filepath.Join(processFolder, p.opts.Prefix+"parse-errors.log")
+		if err := writeParseErrors(result.ParseErrorReport, parseErrors); err != nil {
+			p.log.Errorf("%v", err)
+		}
+		if p.opts.StrictTimestamps {
+			removeFiles(processedLogFiles)
+			return result, fmt.Errorf("%w: %v", ErrMalformedTimestamp, parseErrors[0])
+		}
+	}
+
+	// Lines cut to MaxLineBytes
+	for _, file := range result.Files {
+		if file.Err != nil {
+			continue
+		}
+		result.LongLines += len(file.LongLines)
+		if p.opts.Verbose {
+			for _, line := range file.LongLines {
+				p.log.Infof("%s:%d: line longer than %d bytes was %s", file.Input, line, p.opts.MaxLineBytes, longLineAction(p.opts))
+			}
+		}
+	}
+
+	if p.splitRegex != nil {
+		if processedLogFiles, err = p.splitProcessed(processedLogFiles, delimiter); err != nil {
+			removeFiles(processedLogFiles)
+			return result, err
+		}
+	}
+	if p.opts.PerFileOutput != "" {
+		if result.PerFile, err = p.copyProcessed(processedLogFiles); err != nil {
+			removeFiles(processedLogFiles)
+			return result, err
+		}
+	}
+	if p.opts.NoMerge {
+		p.finish(&result, processedLogFiles, nil, nil)
+		return result, nil
+	}
+
+	// Merge processed logs
+	mergedFilePath := filepath.Join(processFolder, p.opts.Prefix+"MERGED.log")
+	started = time.Now()
+	mergeErr := p.mergeProcessedLogs(processedLogFiles, mergedFilePath)
+	p.stats.Merge = time.Since(started)
+	if err := p.ctx.Err(); err != nil {
+		removeFiles(append(processedLogFiles, mergedFilePath))
+		return result, err
+	}
+	if mergeErr != nil {
+		removeFiles(append(processedLogFiles, mergedFilePath))
+		return result, mergeErr
+	}
+
+	// Determine date pattern from merged log
+	dateTimePattern := p.orderingPattern(p.determineDateTimePattern(mergedFilePath, false))
+	if dateTimePattern == "" {
+		p.log.Warnf("Could not detect date pattern. The ordering step may fail.")
+	}
+
+	// Order logs by date/time
+	orderedFilePath := filepath.Join(processFolder, p.opts.Prefix+"MERGED_ORDERED.log")
+	var orderErr error
+	if p.opts.NoSort {
+		// The pattern is still needed to split the entries back into lines
+		orderedFilePath = mergedFilePath
+	} else {
+		started = time.Now()
+		orderErr = p.orderByDate(mergedFilePath, orderedFilePath, dateTimePattern, delimiter)
+		p.stats.Order = time.Since(started)
+	}
+	if err := p.ctx.Err(); err != nil {
+		removeFiles(append(processedLogFiles, mergedFilePath, orderedFilePath))
+		return result, err
+	}
+	if orderErr != nil {
+		removeFiles(append(processedLogFiles, mergedFilePath, orderedFilePath))
+		return result, orderErr
+	}
+
+	if p.opts.Preview > 0 {
+		started = time.Now()
+		if err := p.formatPreview(orderedFilePath, dateTimePattern, delimiter); err != nil {
+			removeFiles(append(processedLogFiles, mergedFilePath, orderedFilePath))
+			return result, err
+		}
+		p.stats.Format = time.Since(started)
+		p.finish(&result, processedLogFiles, []string{mergedFilePath, orderedFilePath}, p.keptIntermediates(mergedFilePath, orderedFilePath))
+		return result, nil
+	}
+
+	// Format logs (split lines by the continuation delimiter)
+	result.Output = filepath.Join(processFolder, p.opts.Prefix+"FINAL_FORMATTED.log")
+	if p.opts.Format == "json" {
+		result.Output = filepath.Join(processFolder, p.opts.Prefix+"FINAL_FORMATTED.jsonl")
+	}
+	if p.opts.Output != "" {
+		result.Output = p.opts.Output
+	}
+	stream := isStream(result.Output)
+	if p.opts.Gzip && !strings.HasSuffix(result.Output, ".gz") && !stream {
+		result.Output += ".gz"
+	}
+	started = time.Now()
+	var formatErr error
+	if p.opts.Bucket != "" || p.opts.SplitOutputs {
+		result.Buckets, formatErr = p.formatBuckets(orderedFilePath, result.Output, dateTimePattern, delimiter)
+	} else {
+		formatErr = p.formatSupport(orderedFilePath, result.Output, dateTimePattern, delimiter)
+	}
+	p.stats.Format = time.Since(started)
+	if err := p.ctx.Err(); err != nil {
+		created := append(processedLogFiles, mergedFilePath, orderedFilePath)
+		if !stream {
+			created = append(created, result.Output)
+		}
+		removeFiles(append(created, result.Buckets...))
+		return result, err
+	}
+
+	keep := append([]string{result.Output}, result.Buckets...)
+	keep = append(keep, p.keptIntermediates(mergedFilePath, orderedFilePath)...)
+	p.finish(&result, processedLogFiles, []string{mergedFilePath, orderedFilePath}, keep)
+	if formatErr != nil {
+		// The final file was discarded rather than committed
+		return result, formatErr
+	}
+	return result, nil
+}
+
+// keptIntermediates returns which of the merged and ordered files Keep names.
+func (p *pipeline) keptIntermediates(mergedFilePath, orderedFilePath string) []string {
+	var keep []string
+	for _, name := range p.opts.Keep {
+		switch name {
+		case "merged":
+			keep = append(keep, mergedFilePath)
+		case "ordered":
+			keep = append(keep, orderedFilePath)
+		}
+	}
+	return keep
+}
+
+// finish ends a run that created processedLogFiles and the other
+// intermediates in created: it writes the manifest (unless previewing), then
+// removes what was created unless it is in keep or retained by the options.
+func (p *pipeline) finish(result *Result, processedLogFiles, created, keep []string) {
+	// Record which inputs contributed to the output
+	if p.opts.Preview == 0 {
+		manifest := make([]ManifestEntry, len(result.Files))
+		for i, file := range result.Files {
+			manifest[i] = manifestEntry(file)
+		}
+		result.Manifest = ManifestPath(p.opts)
+		if err := WriteManifest(result.Manifest, manifest); err != nil {
+			p.log.Errorf("%v", err)
+			result.Manifest = ""
+		}
+		result.SkippedReport = filepath.Join(processedLogsPath(p.opts), p.opts.Prefix+SkippedFileName)
+		if err := writeSkipped(result.SkippedReport, result.Skipped); err != nil {
+			p.log.Errorf("%v", err)
+			result.SkippedReport = ""
+		}
+	}
+
+	// Clean up
+	if !p.opts.KeepIntermediate {
+		keep = append(keep, result.ParseErrorReport, result.Manifest, result.SkippedReport)
+		if slices.Contains(p.opts.Keep, "processed") || p.opts.Incremental {
+			// Incremental runs reuse them
+			keep = append(keep, processedLogFiles...)
+		}
+		p.cleanupProcessFolder(append(created, processedLogFiles...), keep)
+	}
+	result.Stats = p.stats
+}
+
+// copyProcessed copies processedLogFiles into PerFileOutput, named after
+// their inputs, and returns the copies.
+func (p *pipeline) copyProcessed(processedLogFiles []string) ([]string, error) {
+	if err := os.MkdirAll(p.opts.PerFileOutput, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating --per-file-output folder: %v", err)
+	}
+	copies := make([]string, 0, len(processedLogFiles))
+	for _, processed := range processedLogFiles {
+		name := strings.TrimPrefix(filepath.Base(processed), p.opts.Prefix)
+		path := filepath.Join(p.opts.PerFileOutput, name)
+		if err := copyFile(processed, path); err != nil {
+			return copies, err
+		}
+		copies = append(copies, path)
+	}
+	return copies, nil
+}
+
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	defer in.Close()
+	out, err := createAtomic(to)
+	if err != nil {
+		return fmt.Errorf("error creating file: %v", err)
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	if err := out.Commit(); err != nil {
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	return nil
+}
+
+// longLineAction describes what happens to lines over MaxLineBytes.
+func longLineAction(opts Options) string {
+	if opts.LongLines == "drop" || opts.JSONInput {
+		return "dropped"
+	}
+	return "truncated"
+}
+
+// writeParseErrors writes one "file:line: error: text" record per malformed
+// timestamp to path.
+func writeParseErrors(path string, parseErrors []ParseError) error {
+	var report strings.Builder
+	for _, e := range parseErrors {
+		report.WriteString(e.Error() + "\n")
+	}
+	if err := os.WriteFile(path, []byte(report.String()), 0666); err != nil {
+		return fmt.Errorf("error writing %s: %v", path, err)
+	}
+	return nil
+}
+
+// removeFiles deletes the files a run created when it cannot complete.
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// ProcessStream runs the process, order and format steps in memory on a single
+// log stream read from r and writes the formatted result to w. The folder
+// options, the file filters, the intermediate-file options and Bucket are
+// ignored.
+func ProcessStream(r io.Reader, w io.Writer, opts Options) error {
+	p, err := newPipeline(opts)
+	if err != nil {
+		return err
+	}
+	return p.processStream(r, w)
+}
+
+func (p *pipeline) processStream(r io.Reader, w io.Writer) error {
+	w = encodeOutput(w, p.opts.EncodingOut, true)
+	data, err := io.ReadAll(decodeInput(r, p.opts.Encoding))
+	if err != nil {
+		return fmt.Errorf("error reading stdin: %v", err)
+	}
+
+	delimiter := p.opts.Delimiter
+	var dateTimePattern string
+	if p.opts.JSONInput {
+		dateTimePattern = p.orderingPattern(markedPattern)
+	} else {
+		dateTimePattern = p.orderingPattern(p.detectDateTimePattern(strings.NewReader(string(data))))
+	}
+	if dateTimePattern == "" {
+		return errors.New("unrecognized date pattern in stdin")
+	}
+	compiledRegex, err := regexp.Compile(dateTimePattern)
+	if err != nil {
+		return fmt.Errorf("failed to compile regex pattern: %v", err)
+	}
+
+	var joined strings.Builder
+	var info streamInfo
+	if p.opts.JSONInput {
+		info, err = p.processJSONStream("stdin", strings.NewReader(string(data)), &joined, delimiter)
+	} else {
+		year := p.firstYear(strings.NewReader(string(data)), compiledRegex)
+		info, err = p.processLogStream("stdin", strings.NewReader(string(data)), &joined, compiledRegex, delimiter, year)
+	}
+	if err != nil {
+		return err
+	}
+	if len(info.parseErrors) > 0 {
+		if p.opts.StrictTimestamps {
+			return fmt.Errorf("%w: %v", ErrMalformedTimestamp, info.parseErrors[0])
+		}
+		p.log.Warnf("%d line(s) have a timestamp that could not be parsed.", len(info.parseErrors))
+	}
+	if len(info.longLines) > 0 {
+		p.log.Warnf("%d line(s) longer than %d bytes were %s.", len(info.longLines), p.opts.MaxLineBytes, longLineAction(p.opts))
+	}
+	p.eol = chooseEOL(p.opts.EOL, info.endings)
+
+	if p.opts.NoSort {
+		p.color = p.opts.Color
+		return p.writeFormatted(strings.NewReader(joined.String()), w, dateTimePattern, delimiter)
+	}
+	rawLines := joinedEntries(joined.String())
+	var ordered strings.Builder
+	for _, line := range p.orderLines(rawLines, dateTimePattern, delimiter) {
+		ordered.WriteString(line + "\n")
+	}
+
+	p.color = p.opts.Color
+	return p.writeFormatted(strings.NewReader(ordered.String()), w, dateTimePattern, delimiter)
+}
+
+// Candidate is an input file found by Candidates.
+type Candidate struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	// Pattern is the detected timestamp regex ("" if none) and Format
+	// describes it.
+	Pattern string
+	Format  string
+	// Processable is false when no timestamp was recognized; Process would
+	// skip the file.
+	Processable bool
+}
+
+// Candidates lists the files Process would pick up, with their detected
+// timestamp format, without writing anything.
+func Candidates(opts Options) ([]Candidate, error) {
+	p, err := newPipeline(opts)
+	if err != nil {
+		return nil, err
+	}
+	logFiles, err := p.inputFiles()
+	if err != nil {
+		return nil, err
+	}
+	var candidates []Candidate
+	for _, logFile := range logFiles {
+		c := Candidate{Path: logFile}
+		if info, err := os.Stat(logFile); err == nil {
+			c.Size, c.ModTime = info.Size(), info.ModTime()
+		}
+		c.Pattern = p.determineDateTimePattern(logFile, true)
+		c.Processable = c.Pattern != ""
+		c.Format = p.describePattern(c.Pattern)
+		candidates = append(candidates, c)
+	}
+	return candidates, nil
+}
+
+// Count groups the lines of each input into entries as Process does, with
+// Workers workers, but writes nothing. It returns one result per input, in
+// merge order, with Entries and LinesRead set; inputs Process would skip
+// carry the same Err.
+func Count(opts Options) ([]FileResult, error) {
+	p, err := newPipeline(opts)
+	if err != nil {
+		return nil, err
+	}
+	logFiles, err := p.inputFiles()
+	if err != nil {
+		return nil, err
+	}
+	if len(logFiles) == 0 {
+		return nil, ErrNoLogFiles
+	}
+	return p.processLogs(logFiles, "", opts.Delimiter, false), nil
+}
+
+// Inputs lists the files Process would pick up, in merge order, without
+// reading them and without reporting anything to Log.
+func Inputs(opts Options) ([]string, error) {
+	opts.Log, opts.Verbose = nil, false
+	p, err := newPipeline(opts)
+	if err != nil {
+		return nil, err
+	}
+	return p.inputFiles()
+}
+
+// describePattern names a pattern returned by determineDateTimePattern.
+func (p *pipeline) describePattern(pattern string) string {
+	if pattern == "" {
+		return "unrecognized (would be skipped)"
+	}
+	if p.opts.DatePattern != "" {
+		return "custom --datePattern"
+	}
+	for _, f := range p.formats {
+		if p.anchored(f.filePattern()) == pattern {
+			return fmt.Sprintf("%s (%s)", f.name, f.layout)
+		}
+	}
+	return pattern
+}
+
+// chooseEOL resolves the EOL option to the terminator written to the final file.
+func chooseEOL(mode string, endings lineEndings) string {
+	switch mode {
+	case "crlf":
+		return "\r\n"
+	case "lf":
+		return "\n"
+	}
+	if endings.CRLF > endings.LF {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// inputFiles returns the inputs of the run: Files, each checked to be a
+// regular file, or else the files found in the input folders.
+func (p *pipeline) inputFiles() ([]string, error) {
+	if len(p.opts.Files) == 0 {
+		folders, err := p.inputFolders()
+		if err != nil {
+			return nil, err
+		}
+		return p.getAllLogFiles(folders)
+	}
+	var logFiles []string
+	seen := make(map[string]bool)
+	for _, logFile := range p.opts.Files {
+		info, err := os.Stat(logFile)
+		if err != nil {
+			return nil, fmt.Errorf("input file '%s' cannot be read: %v", logFile, err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("input file '%s' is not a regular file", logFile)
+		}
+		if key := absPath(logFile); !seen[key] {
+			seen[key] = true
+			logFiles = append(logFiles, logFile)
+		}
+	}
+	// Processed files are still named after their inputs
+	return p.resolveCollisions(logFiles)
+}
+
+// inputFolders returns ParentFolder followed by ExtraFolders, checking that
+// each one is a directory.
+func (p *pipeline) inputFolders() ([]string, error) {
+	folders := append([]string{p.opts.ParentFolder}, p.opts.ExtraFolders...)
+	for _, folder := range folders {
+		info, err := os.Stat(folder)
+		if err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("the provided path '%s' is not a valid directory", folder)
+		}
+	}
+	return folders, nil
+}
+
+// processedLogsPath returns the ProcessedLogs folder of a run with opts:
+// WorkDir, or ProcessedLogs in OutputDir or ParentFolder.
+func processedLogsPath(opts Options) string {
+	if opts.WorkDir != "" {
+		return opts.WorkDir
+	}
+	outputDir := opts.OutputDir
+	if outputDir == "" {
+		outputDir = opts.ParentFolder
+	}
+	return filepath.Join(outputDir, ProcessedLogsFolderName)
+}
+
+func (p *pipeline) createProcessedLogsFolder(processedLogsPath string) (string, error) {
+	if _, err := os.Stat(processedLogsPath); os.IsNotExist(err) {
+		mkdir := os.Mkdir
+		if p.opts.WorkDir != "" {
+			// Unlike the folder ProcessedLogs is created in, WorkDir may
+			// not exist yet
+			mkdir = os.MkdirAll
+		}
+		if err := mkdir(processedLogsPath, os.ModePerm); err != nil {
+			return "", fmt.Errorf("error creating ProcessedLogs folder: %v", err)
+		}
+		if p.opts.Verbose {
+			p.log.Infof("ProcessedLogs folder created successfully.")
+		}
+	} else if p.opts.Verbose {
+		p.log.Infof("ProcessedLogs folder already exists.")
+	}
+	return processedLogsPath, nil
+}
+
+// getAllLogFiles searches folders, in order, for input files and applies
+// OnCollision to those sharing a name. A file reached through more than one
+// folder (e.g. nested roots) is listed once. The error is only set by
+// OnCollision "error".
+func (p *pipeline) getAllLogFiles(folders []string) ([]string, error) {
+	var logFiles []string
+	seen := make(map[string]bool)
+	var unreadable []error
+	for _, folder := range folders {
+		found, errs := p.findLogFiles(folder)
+		unreadable = append(unreadable, errs...)
+		for _, logFile := range found {
+			if key := absPath(logFile); !seen[key] {
+				seen[key] = true
+				logFiles = append(logFiles, logFile)
+			}
+		}
+	}
+	if len(unreadable) > 0 {
+		var list strings.Builder
+		for _, err := range unreadable {
+			fmt.Fprintf(&list, "\n  %v", err)
+			p.skipUnreadable(err)
+		}
+		p.log.Warnf("%d path(s) could not be read and were skipped:%s", len(unreadable), list.String())
+	}
+	sortFiles(logFiles, p.opts.SortFiles)
+	if p.opts.LimitFiles > 0 && len(logFiles) > p.opts.LimitFiles {
+		if p.opts.Verbose {
+			p.log.Infof("Using %d of the %d files found (--limit-files).", p.opts.LimitFiles, len(logFiles))
+		}
+		for _, logFile := range logFiles[p.opts.LimitFiles:] {
+			p.skip(logFile, SkipLimit, nil)
+		}
+		logFiles = logFiles[:p.opts.LimitFiles]
+	}
+	logFiles, err := p.resolveCollisions(logFiles)
+	if err != nil || !p.opts.Rotated {
+		return logFiles, err
+	}
+	return orderRotations(logFiles), nil
+}
+
+// sortFiles orders logFiles as SortFiles says. Ties, and files that cannot be
+// read, are ordered by path.
+func sortFiles(logFiles []string, by string) {
+	if by == "" {
+		return
+	}
+	type file struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	files := make([]file, len(logFiles))
+	for i, logFile := range logFiles {
+		files[i].path = logFile
+		if by != "name" {
+			if info, err := os.Stat(logFile); err == nil {
+				files[i].size, files[i].modTime = info.Size(), info.ModTime()
+			}
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		switch {
+		case by == "name" && filepath.Base(a.path) != filepath.Base(b.path):
+			return filepath.Base(a.path) < filepath.Base(b.path)
+		case by == "modtime" && !a.modTime.Equal(b.modTime):
+			return a.modTime.After(b.modTime)
+		case by == "size" && a.size != b.size:
+			return a.size > b.size
+		}
+		return a.path < b.path
+	})
+	for i, f := range files {
+		logFiles[i] = f.path
+	}
+}
+
+// rotationSuffix splits a file name into its stream name and rotation number,
+// e.g. "app.log.2.gz" into "app.log" and "2".
+var rotationSuffix = regexp.MustCompile(`^(.*?)(?:\.(\d+))?(?:\.gz)?$`)
+
+// orderRotations moves the rotations of each stream (app.log.2, app.log.1,
+// app.log in the same folder) together, oldest first, at the position of the
+// first one found. Other files keep their place.
+func orderRotations(logFiles []string) []string {
+	type rotation struct {
+		path   string
+		number int // 0 for the current file
+	}
+	var streams []string
+	rotations := make(map[string][]rotation)
+	for _, logFile := range logFiles {
+		match := rotationSuffix.FindStringSubmatch(filepath.Base(logFile))
+		stream := filepath.Join(filepath.Dir(logFile), match[1])
+		number, _ := strconv.Atoi(match[2])
+		if rotations[stream] == nil {
+			streams = append(streams, stream)
+		}
+		rotations[stream] = append(rotations[stream], rotation{logFile, number})
+	}
+
+	ordered := make([]string, 0, len(logFiles))
+	for _, stream := range streams {
+		group := rotations[stream]
+		// The highest number is the oldest
+		sort.SliceStable(group, func(i, j int) bool { return group[i].number > group[j].number })
+		for _, r := range group {
+			ordered = append(ordered, r.path)
+		}
+	}
+	return ordered
+}
+
+// findLogFiles lists the input files in folderPath, walking its subfolders
+// when Recursive is set. Entries that cannot be read (e.g. permission denied)
+// are skipped and returned as errors instead of ending the search.
+func (p *pipeline) findLogFiles(folderPath string) ([]string, []error) {
+	var logFiles []string
+	var unreadable []error
+	if !p.opts.Recursive {
+		entries, err := os.ReadDir(folderPath)
+		if err != nil {
+			unreadable = append(unreadable, err)
+		}
+		for _, e := range entries {
+			if !e.IsDir() && p.isLogFile(filepath.Join(folderPath, e.Name())) {
+				logFiles = append(logFiles, filepath.Join(folderPath, e.Name()))
+			}
+		}
+		return logFiles, unreadable
+	}
+
+	err := filepath.Walk(folderPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			unreadable = append(unreadable, err)
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Never re-ingest our own output from a previous run.
+		if info.IsDir() && (info.Name() == ProcessedLogsFolderName || p.opts.WorkDir != "" && absPath(path) == absPath(p.opts.WorkDir)) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() && p.opts.MaxDepth > 0 && path != folderPath {
+			// A direct subfolder of folderPath is at depth 1
+			if rel, err := filepath.Rel(folderPath, path); err == nil && strings.Count(rel, string(filepath.Separator))+1 > p.opts.MaxDepth {
+				return filepath.SkipDir
+			}
+		}
+		if !info.IsDir() && p.isLogFile(path) {
+			logFiles = append(logFiles, path)
+		}
+		return nil
+	})
+	if err != nil {
+		unreadable = append(unreadable, err)
+	}
+	return logFiles, unreadable
+}
+
+// isLogFile reports whether the file at path is an input. One with an input
+// extension that Include or Exclude leaves out is recorded as skipped.
+func (p *pipeline) isLogFile(path string) bool {
+	name := filepath.Base(path)
+	if !p.fileRegex.MatchString(name) || p.isOutput(path) {
+		return false
+	}
+	if !p.selectedByName(name) {
+		p.skip(path, SkipExcluded, nil)
+		return false
+	}
+	return true
+}
+
+// isOutput reports whether path is a final file this run writes: Output,
+// with the ".gz" Gzip adds, or one of the Bucket or SplitOutputs files named
+// after it. An Output inside a searched folder would otherwise be read back
+// in on the next run, and with --watch would trigger one run after another.
+func (p *pipeline) isOutput(path string) bool {
+	if p.opts.Output == "" || isStream(p.opts.Output) {
+		return false
+	}
+	output := absPath(p.opts.Output)
+	if p.opts.Gzip && !strings.HasSuffix(output, ".gz") {
+		output += ".gz"
+	}
+	path = absPath(path)
+	if path == output {
+		return true
+	}
+	if p.opts.Bucket == "" && !p.opts.SplitOutputs {
+		return false
+	}
+	// bucketPath inserts "-<key>" before the extension
+	prefix, suffix, _ := strings.Cut(bucketPath(output, "\x00"), "\x00")
+	return len(path) > len(prefix)+len(suffix) && strings.HasPrefix(path, prefix) && strings.HasSuffix(path, suffix)
+}
+
+// extensionsRegex matches names ending in one of extensions, optionally
+// followed by a rotation number (app.log.1), or in .gz.
+func extensionsRegex(extensions []string) (*regexp.Regexp, error) {
+	if len(extensions) == 0 {
+		return nil, errors.New("at least one --ext is required")
+	}
+	quoted := make([]string, len(extensions))
+	for i, ext := range extensions {
+		ext = strings.TrimPrefix(ext, ".")
+		if ext == "" {
+			return nil, errors.New("--ext must not be empty")
+		}
+		quoted[i] = regexp.QuoteMeta(ext)
+	}
+	return regexp.Compile(`\.(?:` + strings.Join(quoted, "|") + `)(\.\d+)?$|\.gz$`)
+}
+
+// resolveCollisions warns about inputs whose processed files would share a
+// name, listing their full paths, and handles them as OnCollision says.
+func (p *pipeline) resolveCollisions(logFiles []string) ([]string, error) {
+	var names []string
+	byName := make(map[string][]string)
+	for _, logFile := range logFiles {
+		name := strings.TrimSuffix(filepath.Base(logFile), ".gz")
+		if byName[name] == nil {
+			names = append(names, name)
+		}
+		byName[name] = append(byName[name], logFile)
+	}
+
+	skipped := make(map[string]bool)
+	for _, name := range names {
+		paths := byName[name]
+		if len(paths) < 2 {
+			continue
+		}
+		switch p.opts.OnCollision {
+		case "error":
+			return nil, fmt.Errorf("%d input files are named %s: %s", len(paths), name, strings.Join(paths, ", "))
+		case "skip":
+			p.log.Warnf("%d input files are named %s; only the first is processed:\n  %s", len(paths), name, strings.Join(paths, "\n  "))
+			for _, path := range paths[1:] {
+				skipped[path] = true
+				p.skip(path, SkipDuplicate, nil)
+			}
+		default:
+			p.log.Warnf("%d input files are named %s; they are processed under numbered names:\n  %s", len(paths), name, strings.Join(paths, "\n  "))
+		}
+	}
+	if len(skipped) == 0 {
+		return logFiles, nil
+	}
+
+	kept := make([]string, 0, len(logFiles)-len(skipped))
+	for _, logFile := range logFiles {
+		if !skipped[logFile] {
+			kept = append(kept, logFile)
+		}
+	}
+	return kept, nil
+}
+
+// selectedByName applies Include/Exclude to a file's base name. A file must
+// match at least one include pattern (when any are given) and no exclude
+// pattern; exclusion always wins.
+func (p *pipeline) selectedByName(name string) bool {
+	for _, pattern := range p.opts.Exclude {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return false
+		}
+	}
+	if len(p.opts.Include) == 0 {
+		return true
+	}
+	for _, pattern := range p.opts.Include {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanupProcessFolder removes the intermediate files this run created, except
+// the paths in keep. Anything else in the ProcessedLogs folder (e.g. a file
+// left by another run or placed there by hand) is never touched, and kept
+// files may live outside it (see Options.Output). As a safeguard for runs
+// sharing the folder, a file without the run's Prefix is never removed.
+func (p *pipeline) cleanupProcessFolder(created, keep []string) {
+	keepPaths := make(map[string]bool, len(keep))
+	for _, path := range keep {
+		if absPath, err := filepath.Abs(path); err == nil {
+			keepPaths[absPath] = true
+		}
+	}
+	for _, path := range created {
+		absPath, err := filepath.Abs(path)
+		if err != nil || keepPaths[absPath] || !strings.HasPrefix(filepath.Base(path), p.opts.Prefix) {
+			continue
+		}
+		// Listed twice with NoSort, where the merged file is also the
+		// ordered one
+		keepPaths[absPath] = true
+		if err := os.Remove(absPath); err != nil && !os.IsNotExist(err) {
+			p.log.Errorf("removing %s: %v", path, err)
+		}
+	}
+}
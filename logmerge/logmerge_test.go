@@ -0,0 +1,188 @@
+package logmerge_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/NL-Cristi/MergeOrderLog/logmerge"
+)
+
+// writeLog writes content to the file at name below dir, creating its
+// folders.
+func writeLog(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readFile returns the content of the file at path.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// inputNames returns the base names of the inputs opts selects, sorted.
+func inputNames(t *testing.T, opts logmerge.Options) []string {
+	t.Helper()
+	candidates, err := logmerge.Candidates(opts)
+	if err != nil {
+		t.Fatalf("Candidates: %v", err)
+	}
+	names := make([]string, len(candidates))
+	for i, c := range candidates {
+		names[i] = filepath.Base(c.Path)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// run processes opts and returns the result and the final file.
+func run(t *testing.T, opts logmerge.Options) (logmerge.Result, string) {
+	t.Helper()
+	result, err := logmerge.Process(opts)
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	return result, readFile(t, result.Output)
+}
+
+func TestProcessTwiceGivesSameOutput(t *testing.T) {
+	dir := t.TempDir()
+	writeLog(t, dir, "a.log", "2023-06-01 10:00:00,000 INFO a1\n2023-06-01 10:00:02,000 INFO a2\n")
+	writeLog(t, dir, "sub/b.log", "2023-06-01 10:00:01,000 INFO b1\n")
+	want := "2023-06-01 10:00:00,000 INFO a1\n" +
+		"2023-06-01 10:00:01,000 INFO b1\n" +
+		"2023-06-01 10:00:02,000 INFO a2\n"
+
+	_, first := run(t, logmerge.DefaultOptions(dir))
+	if first != want {
+		t.Fatalf("first run:\n%s\nwant:\n%s", first, want)
+	}
+	// The second run must not read back ProcessedLogs
+	_, second := run(t, logmerge.DefaultOptions(dir))
+	if second != first {
+		t.Errorf("second run:\n%s\nfirst run:\n%s", second, first)
+	}
+}
+
+func TestIncludeExclude(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"app-1.log", "app-2.log", "debug-1.log", "debug-app.log", "other.log"} {
+		writeLog(t, dir, name, "2023-06-01 10:00:00,000 INFO x\n")
+	}
+	tests := []struct {
+		name             string
+		include, exclude []string
+		want             []string
+	}{
+		{"none", nil, nil, []string{"app-1.log", "app-2.log", "debug-1.log", "debug-app.log", "other.log"}},
+		{"include", []string{"app-*"}, nil, []string{"app-1.log", "app-2.log"}},
+		{"several includes", []string{"app-*", "debug-*"}, nil, []string{"app-1.log", "app-2.log", "debug-1.log", "debug-app.log"}},
+		{"exclude wins", []string{"app-*", "debug-*"}, []string{"debug-*"}, []string{"app-1.log", "app-2.log"}},
+		{"exclude matching an include", []string{"*app*"}, []string{"debug-*"}, []string{"app-1.log", "app-2.log"}},
+		{"several excludes", nil, []string{"*-1.log", "debug-*"}, []string{"app-2.log", "other.log"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := logmerge.DefaultOptions(dir)
+			opts.Include, opts.Exclude = tt.include, tt.exclude
+			if got := inputNames(t, opts); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSameNamedInputsProcessedConcurrently(t *testing.T) {
+	dir := t.TempDir()
+	const folders, lines = 16, 50
+	for f := 0; f < folders; f++ {
+		var content strings.Builder
+		for i := 0; i < lines; i++ {
+			fmt.Fprintf(&content, "2023-06-01 10:00:%02d,%03d INFO node%d line%d\n", i, f, f, i)
+		}
+		writeLog(t, dir, fmt.Sprintf("node%d/app.log", f), content.String())
+	}
+	for i := 0; i < 5; i++ {
+		opts := logmerge.DefaultOptions(dir)
+		opts.Workers = folders
+		result, got := run(t, opts)
+		if result.Failed > 0 {
+			t.Fatalf("%d file(s) failed", result.Failed)
+		}
+		// Every input got a processed file of its own, so nothing is lost
+		// or doubled
+		for f := 0; f < folders; f++ {
+			if n := strings.Count(got, fmt.Sprintf(" node%d ", f)); n != lines {
+				t.Fatalf("run %d: %d entries of node%d, want %d", i, n, f, lines)
+			}
+		}
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"root.log", "d1/one.log", "d1/d2/two.log", "d1/d2/d3/three.log"} {
+		writeLog(t, dir, name, "2023-06-01 10:00:00,000 INFO x\n")
+	}
+	tests := []struct {
+		depth int
+		want  []string
+	}{
+		{0, []string{"one.log", "root.log", "three.log", "two.log"}}, // unlimited
+		{1, []string{"one.log", "root.log"}},
+		{2, []string{"one.log", "root.log", "two.log"}},
+	}
+	for _, tt := range tests {
+		opts := logmerge.DefaultOptions(dir)
+		opts.MaxDepth = tt.depth
+		if got := inputNames(t, opts); !slices.Equal(got, tt.want) {
+			t.Errorf("depth %d: got %v, want %v", tt.depth, got, tt.want)
+		}
+	}
+}
+
+func TestUnreadableFolderIsSkipped(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("folder permissions are not enforced here")
+	}
+	dir := t.TempDir()
+	writeLog(t, dir, "a.log", "2023-06-01 10:00:00,000 INFO readable\n")
+	writeLog(t, dir, "locked/b.log", "2023-06-01 10:00:01,000 INFO hidden\n")
+	writeLog(t, dir, "z/c.log", "2023-06-01 10:00:02,000 INFO found after\n")
+	locked := filepath.Join(dir, "locked")
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(locked, 0755) })
+
+	var log strings.Builder
+	opts := logmerge.DefaultOptions(dir)
+	opts.Log = logmerge.TextLogger(&log)
+	result, got := run(t, opts)
+	want := "2023-06-01 10:00:00,000 INFO readable\n2023-06-01 10:00:02,000 INFO found after\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if len(result.Skipped) != 1 || result.Skipped[0].Reason != logmerge.SkipPermission || result.Skipped[0].Path != locked {
+		t.Errorf("skipped %+v, want %s for %s", result.Skipped, logmerge.SkipPermission, locked)
+	}
+	if !strings.Contains(log.String(), "1 path(s) could not be read") || !strings.Contains(log.String(), locked) {
+		t.Errorf("log does not report %s:\n%s", locked, log.String())
+	}
+}
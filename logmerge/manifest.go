@@ -0,0 +1,81 @@
+package logmerge
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ManifestFileName is the audit record of a run's inputs, written next to the
+// final file.
+const ManifestFileName = "manifest.json"
+
+// ManifestEntry describes one input file in manifest.json.
+type ManifestEntry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"` // on disk, so compressed for .gz inputs
+	ModTime time.Time `json:"modTime"`
+	Pattern string    `json:"pattern,omitempty"` // detected timestamp regex
+	// BytesRead and LinesRead count the (decompressed) input actually read;
+	// both are 0 in a dry run.
+	BytesRead int64  `json:"bytesRead"`
+	LinesRead int    `json:"linesRead"`
+	Skipped   bool   `json:"skipped"`
+	Reason    string `json:"reason,omitempty"` // why it was skipped
+}
+
+// ManifestPath returns where a run with opts writes manifest.json, after
+// opts.Prefix: next to Output when it is set and is not a stream, otherwise in
+// the ProcessedLogs folder.
+func ManifestPath(opts Options) string {
+	if opts.Output != "" && !isStream(opts.Output) {
+		return filepath.Join(filepath.Dir(opts.Output), opts.Prefix+ManifestFileName)
+	}
+	return filepath.Join(processedLogsPath(opts), opts.Prefix+ManifestFileName)
+}
+
+// ManifestEntry describes c as a dry run would record it.
+func (c Candidate) ManifestEntry() ManifestEntry {
+	entry := ManifestEntry{Path: c.Path, Size: c.Size, ModTime: c.ModTime, Pattern: c.Pattern}
+	if !c.Processable {
+		entry.Skipped, entry.Reason = true, "unrecognized date pattern"
+	}
+	return entry
+}
+
+// manifestEntry describes the processed input f.
+func manifestEntry(f FileResult) ManifestEntry {
+	entry := ManifestEntry{
+		Path:      f.Input,
+		Pattern:   f.Pattern,
+		BytesRead: f.BytesRead,
+		LinesRead: f.LinesRead,
+	}
+	if info, err := os.Stat(f.Input); err == nil {
+		entry.Size, entry.ModTime = info.Size(), info.ModTime()
+	}
+	switch {
+	case f.Err != nil:
+		entry.Skipped, entry.Reason = true, f.Err.Error()
+	case f.Empty:
+		entry.Skipped, entry.Reason = true, "empty"
+	}
+	return entry
+}
+
+// WriteManifest writes entries to path as an indented JSON array.
+func WriteManifest(path string, entries []ManifestEntry) error {
+	if entries == nil {
+		entries = []ManifestEntry{}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding manifest: %v", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing manifest: %v", err)
+	}
+	return nil
+}
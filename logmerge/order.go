@@ -0,0 +1,902 @@
+package logmerge
+
+import (
+	"bufio"
+	"container/heap"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logLine holds a parsed timestamp and the raw text of the log line.
+type logLine struct {
+	Timestamp time.Time
+	Raw       string
+	// Index is the line's position in the merged stream (file order, then
+	// line order); it breaks ties between identical timestamps.
+	Index int
+	// Unparsed is set when the line has no timestamp of its own and took
+	// that of the line before it.
+	Unparsed bool
+	// Tiebreak is what TiebreakRegex captured in the entry's first line;
+	// HasTiebreak is set when it matched.
+	Tiebreak    string
+	HasTiebreak bool
+}
+
+// mergeProcessedLogs concatenates logFiles into outputFilePath. Up to Workers
+// files are read ahead concurrently while the output is written in order. A
+// file that cannot be read is reported and skipped; only failing to create or
+// commit the output is returned.
+func (p *pipeline) mergeProcessedLogs(logFiles []string, outputFilePath string) error {
+	defer p.files.release(p.files.acquire(1))
+	outFile, err := createAtomic(outputFilePath)
+	if err != nil {
+		return fmt.Errorf("error creating merged file: %v", err)
+	}
+	defer outFile.Close()
+
+	// Each read-ahead buffer holds at most budget bytes, so together they
+	// stay within MaxMemory; larger files are copied when their turn comes.
+	budget := int64(mergeReadAhead)
+	if p.opts.MaxMemory > 0 {
+		budget = p.opts.MaxMemory / int64(p.opts.Workers)
+	}
+	type readAhead struct {
+		data     []byte
+		err      error
+		streamed bool // too large to buffer
+		done     chan struct{}
+	}
+	files := make([]*readAhead, len(logFiles))
+	for i := range files {
+		files[i] = &readAhead{done: make(chan struct{})}
+	}
+	// A slot is taken before a read starts and given back once the file is
+	// written, so at most Workers buffers exist at a time.
+	slots := make(chan struct{}, p.opts.Workers)
+	go func() {
+		for i, logFile := range logFiles {
+			select {
+			case slots <- struct{}{}:
+			case <-p.ctx.Done():
+				return
+			}
+			go func(f *readAhead, logFile string) {
+				defer close(f.done)
+				defer p.files.release(p.files.acquire(1))
+				if info, err := os.Stat(logFile); err == nil && info.Size() > budget {
+					f.streamed = true
+					return
+				}
+				if f.data, f.err = os.ReadFile(logFile); f.err != nil {
+					f.err = fmt.Errorf("error opening file %s: %v", logFile, f.err)
+				}
+			}(files[i], logFile)
+		}
+	}()
+
+	for i, logFile := range logFiles {
+		f := files[i]
+		select {
+		case <-f.done:
+		case <-p.ctx.Done():
+			return p.ctx.Err()
+		}
+		switch {
+		case f.streamed:
+			taken := p.files.acquire(1)
+			err = p.appendLogFile(outFile, logFile)
+			p.files.release(taken)
+		case f.err != nil:
+			err = f.err
+		default:
+			if len(f.data) > 0 && f.data[len(f.data)-1] != '\n' {
+				// Keep the next file from continuing the last line
+				f.data = append(f.data, '\n')
+			}
+			if _, werr := outFile.Write(f.data); werr != nil {
+				err = fmt.Errorf("error writing %s to merged file: %v", logFile, werr)
+			}
+		}
+		if p.ctx.Err() != nil {
+			return p.ctx.Err()
+		}
+		if err != nil {
+			p.log.Errorf("%v", err)
+			err = nil
+		}
+		f.data = nil
+		<-slots
+	}
+	if err := outFile.Commit(); err != nil {
+		return fmt.Errorf("error writing merged file: %v", err)
+	}
+	if p.opts.Verbose {
+		p.log.Infof("Merged logs saved at: %s", outputFilePath)
+	}
+	return nil
+}
+
+// mergeReadAhead caps each merge read-ahead buffer when MaxMemory is 0.
+const mergeReadAhead = 64 << 20
+
+// appendLogFile copies logFile line by line into w, stopping once p.ctx is
+// done. The file is closed before returning so only one input is open at a
+// time during the merge.
+func (p *pipeline) appendLogFile(w io.Writer, logFile string) error {
+	f, err := os.Open(logFile)
+	if err != nil {
+		return fmt.Errorf("error opening file %s: %v", logFile, err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for lineNumber := 0; ; lineNumber++ {
+		if lineNumber%cancelCheckLines == 0 && p.ctx.Err() != nil {
+			return p.ctx.Err()
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("error reading line from %s: %v", logFile, err)
+		}
+		if line != "" && !strings.HasSuffix(line, "\n") {
+			// The last line has no newline; add one so the next file does
+			// not continue it
+			line += "\n"
+		}
+		if _, werr := io.WriteString(w, line); werr != nil {
+			return fmt.Errorf("error writing %s to merged file: %v", logFile, werr)
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+func (p *pipeline) orderByDate(inputFilePath, outputFilePath, dateTimePattern, delimiter string) error {
+	if dateTimePattern != "" && p.opts.MaxMemory > 0 {
+		if info, err := os.Stat(inputFilePath); err == nil && info.Size() > p.opts.MaxMemory {
+			if err := p.orderByDateExternal(inputFilePath, outputFilePath, dateTimePattern, delimiter); err != nil {
+				return fmt.Errorf("error ordering file: %v", err)
+			}
+			return nil
+		}
+	}
+
+	defer p.files.release(p.files.acquire(2))
+	content, err := os.ReadFile(inputFilePath)
+	if err != nil {
+		return fmt.Errorf("error reading file: %v", err)
+	}
+
+	rawLines := joinedEntries(string(content))
+	sortedLines := p.orderLines(rawLines, dateTimePattern, delimiter)
+
+	outFile, err := createAtomic(outputFilePath)
+	if err != nil {
+		return fmt.Errorf("error creating file %s: %v", outputFilePath, err)
+	}
+	defer outFile.Close()
+	out := bufio.NewWriter(outFile)
+	for _, line := range sortedLines {
+		out.WriteString(line + "\n")
+	}
+	if err := out.Flush(); err != nil {
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	if err := outFile.Commit(); err != nil {
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	return nil
+}
+
+// joinedEntries splits the content of a processed, merged or ordered file into
+// its entries, one per line. Blank lines within an entry are empty segments
+// between delimiters, so they are kept. An empty file holds no entries,
+// rather than one empty entry that would become a stray blank line in the
+// final file.
+func joinedEntries(content string) []string {
+	content = strings.TrimRight(content, "\r\n")
+	if content == "" {
+		return nil
+	}
+	return strings.Split(content, "\n")
+}
+
+// orderLines sorts log entries by their timestamp. Without a pattern the lines
+// are returned as-is.
+func (p *pipeline) orderLines(rawLines []string, dateTimePattern, delimiter string) []string {
+	if dateTimePattern == "" {
+		return rawLines
+	}
+
+	var lines []logLine
+	builder := p.newLogLineBuilder(dateTimePattern, delimiter)
+	for i, l := range rawLines {
+		if line, ok := builder.build(i, l); ok {
+			lines = append(lines, line)
+		}
+	}
+	builder.report()
+
+	if p.opts.PreserveUnparsedPosition {
+		lines = sortAroundUnparsed(lines, p.opts.Reverse)
+	} else {
+		sort.SliceStable(lines, func(i, j int) bool {
+			return lessLogLine(lines[i], lines[j], p.opts.Reverse)
+		})
+	}
+
+	dedup := p.newDeduper(builder.regex)
+	kept := lines[:0]
+	for _, line := range lines {
+		if dedup.keep(line.Raw) {
+			kept = append(kept, line)
+		}
+	}
+	dedup.report()
+	if p.opts.Tail > 0 && len(kept) > p.opts.Tail {
+		if p.opts.Reverse {
+			// The most recent entries come first
+			kept = kept[:p.opts.Tail]
+		} else {
+			kept = kept[len(kept)-p.opts.Tail:]
+		}
+	}
+
+	sortedLines := make([]string, 0, len(kept))
+	for _, line := range kept {
+		p.stats.observe(line)
+		sortedLines = append(sortedLines, line.Raw)
+	}
+	return sortedLines
+}
+
+// sortAroundUnparsed sorts the lines of lines that have a timestamp of their
+// own into the positions they take up, leaving the Unparsed ones where they
+// are (see Options.PreserveUnparsedPosition).
+func sortAroundUnparsed(lines []logLine, reverse bool) []logLine {
+	var parsed []logLine
+	for _, line := range lines {
+		if !line.Unparsed {
+			parsed = append(parsed, line)
+		}
+	}
+	sort.SliceStable(parsed, func(i, j int) bool {
+		return lessLogLine(parsed[i], parsed[j], reverse)
+	})
+	sorted := make([]logLine, 0, len(lines))
+	for _, line := range lines {
+		if !line.Unparsed {
+			line, parsed = parsed[0], parsed[1:]
+		}
+		sorted = append(sorted, line)
+	}
+	return sorted
+}
+
+// deduper drops an entry identical to the one written just before it
+// (Options.Dedup), or to any entry written before it (Options.DedupGlobal).
+// With DedupIgnoreSource the source tag is ignored; DedupGlobal always
+// ignores it so the same entry collected from two sources is dropped.
+type deduper struct {
+	p       *pipeline
+	regex   *regexp.Regexp
+	last    string
+	started bool
+	seen    map[[sha256.Size]byte]struct{} // DedupGlobal: hashes of the entries written
+	removed int
+}
+
+func (p *pipeline) newDeduper(regex *regexp.Regexp) *deduper {
+	d := &deduper{p: p, regex: regex}
+	if p.opts.DedupGlobal {
+		d.seen = make(map[[sha256.Size]byte]struct{})
+	}
+	return d
+}
+
+func (d *deduper) keep(raw string) bool {
+	if d.seen != nil {
+		// Only a hash is kept per entry, but that still grows with the
+		// number of distinct entries in the output.
+		sum := sha256.Sum256([]byte(d.p.stripSourceTag(raw, d.regex)))
+		if _, ok := d.seen[sum]; ok {
+			d.removed++
+			return false
+		}
+		d.seen[sum] = struct{}{}
+		return true
+	}
+	if !d.p.opts.Dedup {
+		return true
+	}
+	key := raw
+	if d.p.opts.DedupIgnoreSource {
+		key = d.p.stripSourceTag(raw, d.regex)
+	}
+	if d.started && key == d.last {
+		d.removed++
+		return false
+	}
+	d.last, d.started = key, true
+	return true
+}
+
+func (d *deduper) report() {
+	if d.p.opts.Dedup || d.p.opts.DedupGlobal {
+		d.p.log.Infof("Removed %d duplicate entries.", d.removed)
+	}
+}
+
+// stripSourceTag removes the --annotate-source tag following the timestamp.
+func (p *pipeline) stripSourceTag(raw string, regex *regexp.Regexp) string {
+	span := p.findTimestamp(regex, raw)
+	if span == nil {
+		return raw
+	}
+	if tag := sourceTag.FindStringIndex(raw[span[1]:]); tag != nil {
+		return raw[:span[1]] + raw[span[1]+tag[1]:]
+	}
+	return raw
+}
+
+// lessLogLine orders by timestamp, newest first when reverse is set, then by
+// the TiebreakRegex capture (see Options.TiebreakRegex), then by position in
+// the merged stream. Ties keep their input order either way, so a line that
+// inherited its timestamp and capture stays right after the entry it belongs
+// to.
+func lessLogLine(a, b logLine, reverse bool) bool {
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return a.Timestamp.Before(b.Timestamp) != reverse
+	}
+	if a.HasTiebreak != b.HasTiebreak {
+		return a.HasTiebreak
+	}
+	if a.Tiebreak != b.Tiebreak {
+		return a.Tiebreak < b.Tiebreak
+	}
+	return a.Index < b.Index
+}
+
+// logLineBuilder turns merged lines into logLines one at a time, carrying the
+// state needed for timestamp inheritance and From/To/Level filtering.
+type logLineBuilder struct {
+	p                *pipeline
+	regex            *regexp.Regexp
+	delimiter        string
+	filtering        bool
+	previousInWindow bool
+	previousLevelOK  bool
+	lastTimestamp    time.Time
+	lastTiebreak     string
+	lastHasTiebreak  bool
+	warnings         int // lines whose timestamp could not be parsed
+}
+
+// maxWarnings is how many unparsed lines are shown one by one unless
+// ShowAllWarnings is set; the rest are only counted.
+const maxWarnings = 10
+
+func (p *pipeline) newLogLineBuilder(dateTimePattern, delimiter string) *logLineBuilder {
+	regex, _ := regexp.Compile(dateTimePattern)
+	return &logLineBuilder{
+		p:                p,
+		regex:            regex,
+		delimiter:        delimiter,
+		filtering:        !p.opts.From.IsZero() || !p.opts.To.IsZero() || !p.since.IsZero(),
+		previousInWindow: true,
+		previousLevelOK:  true,
+	}
+}
+
+// build parses the line at position index. It returns false when the line is
+// filtered out by the time window.
+func (b *logLineBuilder) build(index int, raw string) (logLine, bool) {
+	timestamp, parseErr := b.p.parseTimestampFromLine(raw, b.regex)
+	if parseErr != nil {
+		// With the indent rule entries without any timestamp are expected
+		if b.p.opts.ContinuationRule != "indent" || b.regex.MatchString(raw) {
+			if b.warnings < maxWarnings || b.p.opts.ShowAllWarnings {
+				b.p.log.Warnf("could not parse timestamp for line: %q - error: %v", unescapeDelimiter(raw, b.delimiter), parseErr)
+			}
+			b.warnings++
+		}
+		// Inherit the previous entry's timestamp so the line stays
+		// directly after it instead of sorting to the top.
+		timestamp = b.lastTimestamp
+	} else {
+		b.lastTimestamp = timestamp
+		if b.p.tiebreak != nil {
+			header, _, _ := strings.Cut(raw, b.delimiter)
+			match := b.p.tiebreak.FindStringSubmatch(unescapeDelimiter(header, b.delimiter))
+			b.lastHasTiebreak = match != nil
+			b.lastTiebreak = ""
+			if match != nil {
+				b.lastTiebreak = match[1]
+			}
+		}
+	}
+	if b.filtering {
+		if parseErr == nil {
+			zoned := true
+			if !b.p.since.IsZero() {
+				span := b.p.findTimestamp(b.regex, raw)
+				zoned = hasZone(raw[span[0]:span[1]], b.p.opts.DateLayout)
+			}
+			b.previousInWindow = b.p.inTimeWindow(timestamp, zoned)
+			if !b.previousInWindow {
+				return logLine{}, false
+			}
+		} else if !b.p.opts.KeepUnparsed || !b.previousInWindow {
+			return logLine{}, false
+		}
+	}
+	if b.p.minLevel > 0 {
+		// Lines without their own timestamp travel with the entry before them
+		if parseErr == nil {
+			header, _, _ := strings.Cut(raw, b.delimiter)
+			b.previousLevelOK = b.p.entryLevel(header) >= b.p.minLevel
+		}
+		if !b.previousLevelOK {
+			return logLine{}, false
+		}
+	}
+	return logLine{
+		Timestamp: timestamp, // previous entry's time if parse fails
+		Raw:       raw,
+		Index:     index,
+		Unparsed:  parseErr != nil,
+		// Like the timestamp, inherited by lines without one of their own
+		Tiebreak:    b.lastTiebreak,
+		HasTiebreak: b.lastHasTiebreak,
+	}, true
+}
+
+// report sums up the warnings build did not show.
+func (b *logLineBuilder) report() {
+	if hidden := b.warnings - maxWarnings; hidden > 0 && !b.p.opts.ShowAllWarnings {
+		b.p.log.Warnf("... and %d more line(s) whose timestamp could not be parsed (--show-all-warnings lists them all).", hidden)
+	}
+}
+
+// logLevels ranks the severities understood by Options.Level.
+var logLevels = map[string]int{
+	"TRACE":   1,
+	"DEBUG":   2,
+	"INFO":    3,
+	"WARN":    4,
+	"WARNING": 4,
+	"ERROR":   5,
+	"FATAL":   6,
+}
+
+// entryLevel returns the rank of the level token found in header by the level
+// regex (its first capture group if it has one), or 0 if none is found.
+func (p *pipeline) entryLevel(header string) int {
+	match := p.levelRegex.FindStringSubmatch(header)
+	if match == nil {
+		return 0
+	}
+	token := match[0]
+	if len(match) > 1 {
+		token = match[1]
+	}
+	return logLevels[strings.ToUpper(token)]
+}
+
+// orderByDateExternal sorts files too large for memory: it spills sorted chunks
+// of roughly MaxMemory bytes to temporary files in TmpDir and k-way merges
+// them, first in groups when there are more chunks than MaxOpenFiles allows
+// open at once. With PreserveUnparsedPosition the Unparsed lines go to a
+// file of their own instead, in order, with their position in place of their
+// index, and are put back at those positions during the merge. The result is
+// identical to the in-memory path.
+func (p *pipeline) orderByDateExternal(inputFilePath, outputFilePath, dateTimePattern, delimiter string) error {
+	// The input and the Unparsed lines stay open throughout
+	defer p.files.release(p.files.acquire(2))
+	inFile, err := os.Open(inputFilePath)
+	if err != nil {
+		return fmt.Errorf("error opening file %s: %v", inputFilePath, err)
+	}
+	defer inFile.Close()
+
+	tmpDir := p.opts.TmpDir
+	if tmpDir == "" {
+		tmpDir = filepath.Join(filepath.Dir(outputFilePath), p.opts.Prefix+sortTmpFolderName)
+	}
+	_, statErr := os.Stat(tmpDir)
+	createdTmpDir := os.IsNotExist(statErr)
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return fmt.Errorf("error creating sort folder: %v", err)
+	}
+	var chunkPaths []string
+	var unparsed *os.File
+	var unparsedOut *bufio.Writer
+	defer func() {
+		for _, path := range chunkPaths {
+			os.Remove(path)
+		}
+		if unparsed != nil {
+			unparsed.Close()
+			os.Remove(unparsed.Name())
+		}
+		if createdTmpDir {
+			os.Remove(tmpDir) // only succeeds once it is empty
+		}
+	}()
+
+	var chunk []logLine
+	var chunkBytes int64
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		taken := p.files.acquire(1)
+		path, err := writeSortedChunk(chunk, p.opts.Reverse, tmpDir)
+		p.files.release(taken)
+		if path != "" {
+			chunkPaths = append(chunkPaths, path)
+		}
+		chunk, chunkBytes = nil, 0
+		return err
+	}
+
+	builder := p.newLogLineBuilder(dateTimePattern, delimiter)
+	index, position := 0, 0
+	var addErr error
+	add := func(raw string) {
+		line, ok := builder.build(index, raw)
+		index++
+		if !ok {
+			return
+		}
+		if line.Unparsed && p.opts.PreserveUnparsedPosition {
+			if unparsed == nil {
+				if unparsed, addErr = os.CreateTemp(tmpDir, "mergeorderlog-unparsed-*.tmp"); addErr != nil {
+					addErr = fmt.Errorf("error creating sort chunk: %v", addErr)
+					return
+				}
+				unparsedOut = bufio.NewWriter(unparsed)
+			}
+			line.Index = position
+			writeChunkRecord(unparsedOut, line)
+		} else {
+			chunk = append(chunk, line)
+			chunkBytes += int64(len(raw)) + logLineOverhead
+		}
+		position++
+	}
+
+	reader := bufio.NewReader(inFile)
+	pendingBlank := 0
+	for {
+		raw, readErr := reader.ReadString('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return fmt.Errorf("error reading %s: %v", inputFilePath, readErr)
+		}
+		if readErr != nil && raw == "" {
+			break
+		}
+		raw = strings.TrimSuffix(raw, "\n")
+		if raw == "" {
+			// Trailing blank lines are dropped, as in the in-memory path, so
+			// blank lines are only emitted once a non-blank line follows.
+			pendingBlank++
+		} else {
+			for ; pendingBlank > 0; pendingBlank-- {
+				add("")
+			}
+			add(raw)
+		}
+		if chunkBytes >= p.opts.MaxMemory {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if addErr != nil {
+			return addErr
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	builder.report()
+	if err := flush(); err != nil {
+		return err
+	}
+	var pinned io.Reader // a nil *os.File would not be a nil io.Reader
+	if unparsed != nil {
+		if err := unparsedOut.Flush(); err != nil {
+			return fmt.Errorf("error writing sort chunk: %v", err)
+		}
+		if _, err := unparsed.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("error reading sort chunk: %v", err)
+		}
+		pinned = unparsed
+	}
+
+	// Besides the chunks, the input, the Unparsed lines and the output
+	if chunkPaths, err = p.reduceChunks(chunkPaths, p.files.size-3, tmpDir); err != nil {
+		return err
+	}
+	defer p.files.release(p.files.acquire(len(chunkPaths) + 1))
+	outFile, err := createAtomic(outputFilePath)
+	if err != nil {
+		return fmt.Errorf("error creating file %s: %v", outputFilePath, err)
+	}
+	defer outFile.Close()
+	if err := p.mergeSortedChunks(chunkPaths, pinned, outFile, builder.regex); err != nil {
+		return err
+	}
+	return outFile.Commit()
+}
+
+// sortTmpFolderName is the default TmpDir, created next to the ordered file.
+const sortTmpFolderName = "sort-tmp"
+
+// logLineOverhead approximates the in-memory cost of a logLine beyond its text.
+const logLineOverhead = 64
+
+// writeSortedChunk sorts chunk and writes it to a temporary file in dir, one
+// record per line (see writeChunkRecord).
+func writeSortedChunk(chunk []logLine, reverse bool, dir string) (string, error) {
+	sort.SliceStable(chunk, func(i, j int) bool {
+		return lessLogLine(chunk[i], chunk[j], reverse)
+	})
+
+	f, err := os.CreateTemp(dir, "mergeorderlog-sort-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("error creating sort chunk: %v", err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, line := range chunk {
+		writeChunkRecord(w, line)
+	}
+	if err := w.Flush(); err != nil {
+		return f.Name(), fmt.Errorf("error writing sort chunk: %v", err)
+	}
+	return f.Name(), nil
+}
+
+// writeChunkRecord writes line to w as a "timestamp\tindex\ttiebreak\traw"
+// record. The tiebreak is quoted, so it holds no tab, and left empty when
+// HasTiebreak is not set.
+func writeChunkRecord(w io.Writer, line logLine) {
+	tiebreak := ""
+	if line.HasTiebreak {
+		tiebreak = strconv.Quote(line.Tiebreak)
+	}
+	fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", line.Timestamp.Format(time.RFC3339Nano), line.Index, tiebreak, line.Raw)
+}
+
+// reduceChunks merges the chunk files fanIn at a time into new chunk files
+// until at most fanIn are left, and returns those. On error the result also
+// holds the files of the failed group, for removal.
+func (p *pipeline) reduceChunks(chunkPaths []string, fanIn int, dir string) ([]string, error) {
+	for len(chunkPaths) > fanIn {
+		group := chunkPaths[:fanIn]
+		taken := p.files.acquire(fanIn + 1)
+		path, err := mergeChunkFiles(group, p.opts.Reverse, dir)
+		p.files.release(taken)
+		if path != "" {
+			chunkPaths = append(chunkPaths, path)
+		}
+		if err != nil {
+			return chunkPaths, err
+		}
+		for _, path := range group {
+			os.Remove(path)
+		}
+		chunkPaths = chunkPaths[fanIn:]
+	}
+	return chunkPaths, nil
+}
+
+// mergeChunkFiles merges the chunk files at paths into a new one in dir.
+// Records keep their index, so the final merge orders them as if they had
+// never been merged.
+func mergeChunkFiles(paths []string, reverse bool, dir string) (string, error) {
+	h, files, err := openChunks(paths, reverse)
+	defer closeFiles(files)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, "mergeorderlog-sort-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("error creating sort chunk: %v", err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for h.Len() > 0 {
+		c := h.readers[0]
+		line := c.current
+		writeChunkRecord(w, line)
+		ok, err := c.next()
+		if err != nil {
+			return f.Name(), fmt.Errorf("error reading sort chunk: %v", err)
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return f.Name(), fmt.Errorf("error writing sort chunk: %v", err)
+	}
+	return f.Name(), nil
+}
+
+// openChunks opens the chunk files at paths as a heap of their first records.
+// The files are returned, to be closed, even on error.
+func openChunks(paths []string, reverse bool) (*chunkHeap, []*os.File, error) {
+	h := &chunkHeap{reverse: reverse}
+	var files []*os.File
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, files, fmt.Errorf("error opening sort chunk: %v", err)
+		}
+		files = append(files, f)
+
+		c := &chunkReader{reader: bufio.NewReader(f)}
+		ok, err := c.next()
+		if err != nil {
+			return nil, files, fmt.Errorf("error reading sort chunk %s: %v", path, err)
+		}
+		if ok {
+			h.readers = append(h.readers, c)
+		}
+	}
+	heap.Init(h)
+	return h, files, nil
+}
+
+// closeFiles closes each of files.
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// chunkReader yields the records of one sorted chunk file in order.
+type chunkReader struct {
+	reader  *bufio.Reader
+	current logLine
+}
+
+func (c *chunkReader) next() (bool, error) {
+	record, err := c.reader.ReadString('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) && record == "" {
+			return false, nil
+		}
+		if !errors.Is(err, io.EOF) {
+			return false, err
+		}
+	}
+	fields := strings.SplitN(strings.TrimSuffix(record, "\n"), "\t", 4)
+	if len(fields) != 4 {
+		return false, fmt.Errorf("malformed sort chunk record %q", record)
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		return false, err
+	}
+	index, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return false, err
+	}
+	c.current = logLine{Timestamp: timestamp, Index: index, Raw: fields[3]}
+	if fields[2] != "" {
+		if c.current.Tiebreak, err = strconv.Unquote(fields[2]); err != nil {
+			return false, err
+		}
+		c.current.HasTiebreak = true
+	}
+	return true, nil
+}
+
+// chunkHeap is a min-heap of chunk readers keyed by their current line.
+type chunkHeap struct {
+	readers []*chunkReader
+	reverse bool
+}
+
+func (h *chunkHeap) Len() int { return len(h.readers) }
+func (h *chunkHeap) Less(i, j int) bool {
+	return lessLogLine(h.readers[i].current, h.readers[j].current, h.reverse)
+}
+func (h *chunkHeap) Swap(i, j int) { h.readers[i], h.readers[j] = h.readers[j], h.readers[i] }
+func (h *chunkHeap) Push(x any)    { h.readers = append(h.readers, x.(*chunkReader)) }
+func (h *chunkHeap) Pop() any {
+	old := h.readers
+	item := old[len(old)-1]
+	h.readers = old[:len(old)-1]
+	return item
+}
+
+// mergeSortedChunks k-way merges the chunk files into w, ending each line with
+// "\n" like the in-memory path. The lines of unparsed, when not nil, are
+// written at the positions their Index holds.
+func (p *pipeline) mergeSortedChunks(chunkPaths []string, unparsed io.Reader, w io.Writer, regex *regexp.Regexp) error {
+	h, files, err := openChunks(chunkPaths, p.opts.Reverse)
+	defer closeFiles(files)
+	if err != nil {
+		return err
+	}
+
+	pinned := &chunkReader{}
+	pinnedOK := false
+	if unparsed != nil {
+		pinned.reader = bufio.NewReader(unparsed)
+		var err error
+		if pinnedOK, err = pinned.next(); err != nil {
+			return fmt.Errorf("error reading sort chunk: %v", err)
+		}
+	}
+
+	out := bufio.NewWriter(w)
+	dedup := p.newDeduper(regex)
+	written := 0
+	var tail []logLine // last Tail entries, written once the merge is done
+	emit := func(line logLine) {
+		if !dedup.keep(line.Raw) {
+			return
+		}
+		if p.opts.Tail > 0 && !p.opts.Reverse {
+			tail = append(tail, line)
+			if len(tail) >= 2*p.opts.Tail {
+				tail = append(tail[:0], tail[len(tail)-p.opts.Tail:]...)
+			}
+		} else if p.opts.Tail == 0 || written < p.opts.Tail {
+			out.WriteString(line.Raw + "\n")
+			p.stats.observe(line)
+			written++
+		}
+	}
+	for position := 0; h.Len() > 0 || pinnedOK; position++ {
+		if pinnedOK && (pinned.current.Index == position || h.Len() == 0) {
+			emit(pinned.current)
+			var err error
+			if pinnedOK, err = pinned.next(); err != nil {
+				return fmt.Errorf("error reading sort chunk: %v", err)
+			}
+			continue
+		}
+		c := h.readers[0]
+		emit(c.current)
+
+		ok, err := c.next()
+		if err != nil {
+			return fmt.Errorf("error reading sort chunk: %v", err)
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	dedup.report()
+	if len(tail) > p.opts.Tail {
+		tail = tail[len(tail)-p.opts.Tail:]
+	}
+	for _, line := range tail {
+		out.WriteString(line.Raw + "\n")
+		p.stats.observe(line)
+	}
+	return out.Flush()
+}
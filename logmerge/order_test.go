@@ -0,0 +1,108 @@
+package logmerge_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/NL-Cristi/MergeOrderLog/logmerge"
+)
+
+func TestEqualTimestampsKeepMergeOrder(t *testing.T) {
+	dir := t.TempDir()
+	var a, b, want strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&a, "2023-06-01 10:00:00,000 INFO a%d\n", i)
+		fmt.Fprintf(&b, "2023-06-01 10:00:00,000 INFO b%d\n", i)
+	}
+	writeLog(t, dir, "a.log", a.String())
+	writeLog(t, dir, "b.log", b.String())
+	// Ties go by file, then by line
+	want.WriteString(a.String())
+	want.WriteString(b.String())
+
+	for i := 0; i < 5; i++ {
+		opts := logmerge.DefaultOptions(dir)
+		opts.Workers = 4
+		_, got := run(t, opts)
+		if got != want.String() {
+			t.Fatalf("run %d:\n%s\nwant:\n%s", i, got, want.String())
+		}
+	}
+}
+
+func TestStackTraceStaysUnderItsHeader(t *testing.T) {
+	dir := t.TempDir()
+	// Unjoined lines, as Order may be given them: the trace lines have no
+	// timestamp of their own
+	in := writeLog(t, dir, "merged.log", "2023-06-01 10:00:02,000 INFO later\n"+
+		"2023-06-01 10:00:01,000 ERROR boom\n"+
+		"java.lang.IllegalStateException: boom\n"+
+		"\tat com.example.Handler.run(Handler.java:42)\n"+
+		"2023-06-01 10:00:00,000 INFO earlier\n")
+	out := filepath.Join(dir, "ordered.log")
+	if err := logmerge.Order(in, out, logmerge.DefaultOptions(dir)); err != nil {
+		t.Fatal(err)
+	}
+	want := "2023-06-01 10:00:00,000 INFO earlier\n" +
+		"2023-06-01 10:00:01,000 ERROR boom\n" +
+		"java.lang.IllegalStateException: boom\n" +
+		"\tat com.example.Handler.run(Handler.java:42)\n" +
+		"2023-06-01 10:00:02,000 INFO later\n"
+	if got := readFile(t, out); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSyslogYearWrap(t *testing.T) {
+	dir := t.TempDir()
+	writeLog(t, dir, "a.log", "Dec 31 23:59:58 host a last of the old year\n"+
+		"Jan 01 00:00:02 host a second of the new year\n")
+	writeLog(t, dir, "b.log", "Jan 01 00:00:01 host b first of the new year\n")
+	opts := logmerge.DefaultOptions(dir)
+	opts.AssumeYear = 2024
+	// The December line of a.log comes before its wrap, so it is in 2023 and
+	// sorts before both January lines instead of after them
+	_, got := run(t, opts)
+	want := "Dec 31 23:59:58 host a last of the old year\n" +
+		"Jan 01 00:00:01 host b first of the new year\n" +
+		"Jan 01 00:00:02 host a second of the new year\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestPreserveUnparsedPosition(t *testing.T) {
+	dir := t.TempDir()
+	in := writeLog(t, dir, "merged.log", "2023-06-01 10:00:02,000 INFO c\n"+
+		"a line without a timestamp\n"+
+		"2023-06-01 10:00:00,000 INFO a\n"+
+		"2023-06-01 10:00:01,000 INFO b\n")
+	tests := []struct {
+		preserve bool
+		want     string
+	}{
+		// By default the line takes the time of c and stays after it
+		{false, "2023-06-01 10:00:00,000 INFO a\n" +
+			"2023-06-01 10:00:01,000 INFO b\n" +
+			"2023-06-01 10:00:02,000 INFO c\n" +
+			"a line without a timestamp\n"},
+		// Preserved, it keeps the second position and the others sort around it
+		{true, "2023-06-01 10:00:00,000 INFO a\n" +
+			"a line without a timestamp\n" +
+			"2023-06-01 10:00:01,000 INFO b\n" +
+			"2023-06-01 10:00:02,000 INFO c\n"},
+	}
+	for _, tt := range tests {
+		opts := logmerge.DefaultOptions(dir)
+		opts.PreserveUnparsedPosition = tt.preserve
+		out := filepath.Join(dir, "ordered.log")
+		if err := logmerge.Order(in, out, opts); err != nil {
+			t.Fatal(err)
+		}
+		if got := readFile(t, out); got != tt.want {
+			t.Errorf("preserve %v:\n%s\nwant:\n%s", tt.preserve, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,859 @@
+package logmerge
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileResult describes the outcome of processing one input file.
+type FileResult struct {
+	Input     string
+	Processed string // processed intermediate file; "" if it failed or was not started
+	Err       error
+	// Pattern is the detected timestamp pattern; LinesRead and BytesRead
+	// count the (decompressed) input read, including a failed file's
+	// partial read.
+	Pattern   string
+	LinesRead int
+	BytesRead int64
+	// Entries counts the entries the lines were grouped into.
+	Entries int
+	// Duration is the wall-clock time spent processing the input; 0 when it
+	// was skipped or reused from the Incremental cache.
+	Duration time.Duration
+	// Earliest and Latest are the extreme parsed entry timestamps (zero when
+	// there were none).
+	Earliest, Latest time.Time
+	// ParseErrors lists the lines whose timestamp matched the date pattern
+	// but could not be parsed.
+	ParseErrors []ParseError
+	// LongLines lists the numbers of the lines longer than MaxLineBytes,
+	// which were truncated or dropped as LongLines says.
+	LongLines []int
+	// ModTimeFallback is set when the input had no usable timestamps and
+	// was ordered by its modification time (FallbackModTime).
+	ModTimeFallback bool
+	// Empty is set when the input was skipped for holding nothing but
+	// whitespace (SkipEmpty).
+	Empty   bool
+	endings lineEndings
+}
+
+// ParseError is a line whose timestamp matched the date pattern but could not
+// be parsed, e.g. "2023-13-40 10:00:00,000". Such a line sorts with the entry
+// before it.
+type ParseError struct {
+	File string
+	Line int
+	Text string
+	Err  error
+}
+
+func (e ParseError) Error() string {
+	return fmt.Sprintf("%s:%d: %v: %s", e.File, e.Line, e.Err, e.Text)
+}
+
+// streamInfo is what processLogStream learns about an input besides its
+// entries.
+type streamInfo struct {
+	pattern          string
+	lines            int
+	entries          int
+	bytes            int64
+	earliest, latest time.Time
+	endings          lineEndings
+	parseErrors      []ParseError
+	longLines        []int // numbers of the lines over MaxLineBytes
+	modTimeFallback  bool
+}
+
+// lineEndings counts the line terminators seen in an input.
+type lineEndings struct {
+	LF, CRLF int
+}
+
+func (e *lineEndings) add(other lineEndings) {
+	e.LF += other.LF
+	e.CRLF += other.CRLF
+}
+
+// processLogs processes logFiles with Workers workers and returns one result
+// per input, in input order. With processFolder "" nothing is written. With
+// stopOnError set, no new files are started after the first failure; none are
+// started either once p.ctx is done.
+func (p *pipeline) processLogs(logFiles []string, processFolder, delimiter string, stopOnError bool) []FileResult {
+	jobs := make(chan int, len(logFiles))
+	results := make([]FileResult, len(logFiles)) // indexed by input position so merge order is stable
+	progress := newProgressReporter(p.opts.Progress, len(logFiles))
+	defer progress.finish()
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+
+	// process processes logFiles[i] into results[i]
+	process := func(i int) {
+		logFile := logFiles[i]
+		if p.opts.SkipEmpty && p.isBlankInput(logFile) {
+			if p.opts.Verbose {
+				p.log.Infof("Skipping empty file %s", logFile)
+			}
+			results[i] = FileResult{Input: logFile, Empty: true}
+			progress.increment()
+			return
+		}
+		// Processed output is always plain text
+		var processedLogFile string
+		var err error
+		if processFolder != "" {
+			baseFileName := p.opts.Prefix + strings.TrimSuffix(filepath.Base(logFile), ".gz")
+			processedLogFile, err = getUniqueFileName(filepath.Join(processFolder, baseFileName))
+		}
+		if err != nil {
+			results[i] = FileResult{Input: logFile, Err: fmt.Errorf("%s was not processed: %v", logFile, err)}
+			if stopOnError {
+				stopOnce.Do(func() { close(stop) })
+			}
+			progress.increment()
+			return
+		}
+
+		started := time.Now()
+		info, err := p.processLogFile(logFile, processedLogFile, delimiter)
+		results[i] = FileResult{
+			Input:           logFile,
+			Pattern:         info.pattern,
+			LinesRead:       info.lines,
+			Entries:         info.entries,
+			BytesRead:       info.bytes,
+			Duration:        time.Since(started),
+			Earliest:        info.earliest,
+			Latest:          info.latest,
+			ParseErrors:     info.parseErrors,
+			LongLines:       info.longLines,
+			ModTimeFallback: info.modTimeFallback,
+			endings:         info.endings,
+		}
+		if err != nil {
+			os.Remove(processedLogFile) // drop any partial output
+			// Wrapped, so skipped.json can tell why
+			results[i].Err = fmt.Errorf("%s was not processed: %w", logFile, err)
+			if stopOnError {
+				stopOnce.Do(func() { close(stop) })
+			}
+		} else {
+			results[i].Processed = processedLogFile
+		}
+		progress.increment()
+	}
+
+	var wg sync.WaitGroup
+
+	// Spawn Workers workers
+	for w := 0; w < p.opts.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				select {
+				case <-stop:
+					return
+				case <-p.ctx.Done():
+					return
+				default:
+				}
+
+				// The input, the processed file and a second reader of the
+				// input: pattern detection, the year pass of year-less
+				// timestamps or the FallbackModTime pass
+				taken := p.files.acquire(3)
+				process(i)
+				p.files.release(taken)
+			}
+		}()
+	}
+
+	// Enqueue jobs
+	for i := range logFiles {
+		jobs <- i
+	}
+	close(jobs)
+
+	// Wait for workers to finish
+	wg.Wait()
+
+	for i := range results {
+		results[i].Input = logFiles[i]
+	}
+	return results
+}
+
+// progressReporter prints "processed N/M" to w, at most every
+// progressInterval. It does nothing when w is nil.
+type progressReporter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	tty     bool
+	total   int
+	done    int
+	printed time.Time
+}
+
+const progressInterval = 200 * time.Millisecond
+
+func newProgressReporter(w io.Writer, total int) *progressReporter {
+	f, ok := w.(*os.File)
+	return &progressReporter{w: w, tty: ok && isTerminal(f), total: total}
+}
+
+func (p *progressReporter) increment() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if p.w == nil || (p.done < p.total && time.Since(p.printed) < progressInterval) {
+		return
+	}
+	p.printed = time.Now()
+	if p.tty {
+		// Redraw in place on a terminal
+		fmt.Fprintf(p.w, "\rprocessed %d/%d", p.done, p.total)
+	} else {
+		fmt.Fprintf(p.w, "processed %d/%d\n", p.done, p.total)
+	}
+}
+
+func (p *progressReporter) finish() {
+	if p.w != nil && p.tty && !p.printed.IsZero() {
+		fmt.Fprintln(p.w)
+	}
+}
+
+// isTerminal reports whether f is attached to a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// getUniqueFileName reserves a path based on filePath that no other file
+// uses, appending a counter before the extension when needed. The file is
+// created with O_EXCL so concurrent workers never receive the same name.
+func getUniqueFileName(filePath string) (string, error) {
+	directory := filepath.Dir(filePath)
+	fileNameWithoutExtension := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+	extension := filepath.Ext(filePath)
+
+	count := 1
+	newFilePath := filePath
+
+	for {
+		f, err := os.OpenFile(newFilePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			return newFilePath, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+		newFilePath = filepath.Join(directory, fmt.Sprintf("%s%d%s", fileNameWithoutExtension, count, extension))
+		count++
+	}
+}
+
+func (p *pipeline) processLogFile(inputFilePath, outputFilePath, delimiter string) (streamInfo, error) {
+	inFile, err := p.openInput(inputFilePath)
+	if err != nil {
+		return streamInfo{}, fmt.Errorf("error opening file %s: %w", inputFilePath, err)
+	}
+	defer inFile.Close()
+
+	if p.opts.JSONInput {
+		outFile, err := createProcessed(outputFilePath)
+		if err != nil {
+			return streamInfo{}, fmt.Errorf("error creating output file %s: %v", outputFilePath, err)
+		}
+		defer outFile.Close()
+		return p.processJSONStream(inputFilePath, inFile, outFile, delimiter)
+	}
+
+	dateTimePattern := p.determineDateTimePattern(inputFilePath, true)
+	if dateTimePattern == "" && p.opts.FallbackModTime {
+		return p.processByModTime(inputFilePath, outputFilePath, delimiter)
+	}
+	if dateTimePattern == "" {
+		return streamInfo{}, fmt.Errorf("skipping file %s due to %w", inputFilePath, errUnrecognizedPattern)
+	}
+
+	entryPattern := dateTimePattern
+	if p.opts.MixedFormats {
+		// Every active format starts an entry, as in ProcessStream
+		entryPattern = p.orderingPattern(dateTimePattern)
+	}
+	compiledRegex, err := regexp.Compile(entryPattern)
+	if err != nil {
+		return streamInfo{pattern: dateTimePattern}, fmt.Errorf("failed to compile regex pattern: %v", err)
+	}
+
+	outFile, err := createProcessed(outputFilePath)
+	if err != nil {
+		return streamInfo{pattern: dateTimePattern}, fmt.Errorf("error creating output file %s: %v", outputFilePath, err)
+	}
+	defer outFile.Close()
+
+	year := p.opts.AssumeYear
+	syslog := slices.ContainsFunc(p.formats, func(f timestampFormat) bool { return f.name == "syslog" })
+	if dateTimePattern == p.anchored(syslogPattern) || p.opts.MixedFormats && syslog {
+		// Finding the year takes a pass of its own over the file
+		f, err := p.openInput(inputFilePath)
+		if err != nil {
+			return streamInfo{pattern: dateTimePattern}, fmt.Errorf("error opening file %s: %v", inputFilePath, err)
+		}
+		year = p.firstYear(f, compiledRegex)
+		f.Close()
+	}
+
+	info, err := p.processLogStream(inputFilePath, inFile, outFile, compiledRegex, delimiter, year)
+	info.pattern = dateTimePattern
+	if err == nil && p.opts.FallbackModTime && info.earliest.IsZero() {
+		// The pattern matched, but not a single timestamp could be parsed
+		outFile.Close()
+		return p.processByModTime(inputFilePath, outputFilePath, delimiter)
+	}
+	return info, err
+}
+
+// createProcessed creates the processed file at path, or discards what is
+// written when path is "" (Count).
+func createProcessed(path string) (io.WriteCloser, error) {
+	if path == "" {
+		return discardCloser{io.Discard}, nil
+	}
+	return os.Create(path)
+}
+
+// discardCloser is an io.Writer with a Close that does nothing.
+type discardCloser struct{ io.Writer }
+
+func (discardCloser) Close() error { return nil }
+
+// processByModTime processes inputFilePath, which has no usable timestamps,
+// for FallbackModTime.
+func (p *pipeline) processByModTime(inputFilePath, outputFilePath, delimiter string) (streamInfo, error) {
+	stat, err := os.Stat(inputFilePath)
+	if err != nil {
+		return streamInfo{}, fmt.Errorf("error opening file %s: %v", inputFilePath, err)
+	}
+	inFile, err := p.openInput(inputFilePath)
+	if err != nil {
+		return streamInfo{}, fmt.Errorf("error opening file %s: %v", inputFilePath, err)
+	}
+	defer inFile.Close()
+	outFile, err := createProcessed(outputFilePath)
+	if err != nil {
+		return streamInfo{}, fmt.Errorf("error creating output file %s: %v", outputFilePath, err)
+	}
+	defer outFile.Close()
+
+	if p.opts.Verbose {
+		p.log.Infof("No timestamps in %s; ordering it by its modification time", inputFilePath)
+	}
+	info, err := p.processModTimeStream(inputFilePath, inFile, outFile, delimiter, stat.ModTime())
+	info.modTimeFallback = true
+	return info, err
+}
+
+// processModTimeStream is processLogStream for FallbackModTime: every line is
+// an entry of its own, marked (see tsMarker) with base plus its zero-based
+// line index in nanoseconds.
+func (p *pipeline) processModTimeStream(name string, r io.Reader, w io.Writer, delimiter string, base time.Time) (streamInfo, error) {
+	reader := lineReader{r: bufio.NewReader(r), max: int(p.opts.MaxLineBytes)}
+	out := bufio.NewWriter(w)
+	var entry []byte
+	var info streamInfo
+	for {
+		if info.lines%cancelCheckLines == 0 && p.ctx.Err() != nil {
+			return info, p.ctx.Err()
+		}
+		line, err := reader.next()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return info, fmt.Errorf("error reading line %d: %v", info.lines+1, err)
+		}
+		if err != nil && len(line) == 0 {
+			break
+		}
+		atEOF := err != nil
+		ts := base.Add(time.Duration(info.lines))
+		info.lines++
+		info.bytes += int64(len(line)) + reader.cut
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			info.endings.CRLF++
+		} else if bytes.HasSuffix(line, []byte("\n")) {
+			info.endings.LF++
+		}
+		if reader.cut > 0 {
+			info.longLines = append(info.longLines, info.lines)
+			if p.opts.LongLines == "drop" {
+				if atEOF {
+					break
+				}
+				continue
+			}
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if p.opts.LineTransform != nil {
+			line = []byte(p.opts.LineTransform(name, string(line)))
+		}
+		if info.earliest.IsZero() {
+			info.earliest = ts
+		}
+		info.latest = ts
+
+		// The space after the marker is dropped with it, so a line starting
+		// with one keeps it
+		entry = append(entry[:0], tsMarker+ts.UTC().Format(time.RFC3339Nano)+tsMarker+" "...)
+		if p.opts.AnnotateSource || p.opts.Format == "json" {
+			entry = append(entry, "["+filepath.Base(name)+"] "...)
+		}
+		entry = append(appendEscaped(entry, line, delimiter), '\n')
+		info.entries++
+		if _, err := out.Write(entry); err != nil {
+			return info, fmt.Errorf("error writing output: %v", err)
+		}
+		if atEOF {
+			break
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return info, fmt.Errorf("error writing output: %v", err)
+	}
+	return info, nil
+}
+
+// openLogFile opens a log for reading, transparently decompressing files whose
+// name ends in .gz.
+func (p *pipeline) openLogFile(filePath string) (io.ReadCloser, error) {
+	f, err := p.openFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(strings.ToLower(filePath), ".gz") {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return gzipFile{gz, f}, nil
+}
+
+// isBlankInput reports whether the decoded content of filePath is empty or only
+// whitespace. It reads no further than the first other byte, and a file that
+// cannot be read is not blank, so that processing reports the error.
+func (p *pipeline) isBlankInput(filePath string) bool {
+	f, err := p.openInput(filePath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err == io.EOF
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n', '\v', '\f':
+		default:
+			return false
+		}
+	}
+}
+
+// openInput is openLogFile for an original log file, decoded to UTF-8 as
+// Encoding says.
+func (p *pipeline) openInput(filePath string) (io.ReadCloser, error) {
+	f, err := p.openLogFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return decodedFile{decodeInput(f, p.opts.Encoding), f}, nil
+}
+
+// decodedFile reads the decoded stream and closes the file it came from.
+type decodedFile struct {
+	io.Reader
+	io.Closer
+}
+
+// gzipFile closes both the gzip stream and the underlying file.
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g gzipFile) Close() error {
+	err := g.Reader.Close()
+	if cerr := g.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// cancelCheckLines is how often, in lines, processLogStream and the merge
+// check for cancellation.
+const cancelCheckLines = 4096
+
+// processLogStream joins each line starting an entry with the lines that
+// continue it, as ContinuationRule decides, and writes one entry per line to
+// w. Blank continuation lines become empty segments, so splitEntry gives the
+// entry back exactly. name is only used in diagnostics. It also counts the
+// line endings it reads and records the timestamps that cannot be parsed.
+// Year-less timestamps start in year and are prefixed with a yearMarker.
+func (p *pipeline) processLogStream(name string, r io.Reader, w io.Writer, compiledRegex *regexp.Regexp, delimiter string, year int) (streamInfo, error) {
+	// The hot loop works on bytes: lines are read into and entries built in
+	// buffers reused throughout, so a line costs no allocation of its own.
+	reader := lineReader{r: bufio.NewReader(r), max: int(p.opts.MaxLineBytes)}
+	out := bufio.NewWriter(w)
+	years := yearTracker{year: year}
+	var currentLogEntry []byte
+	var info streamInfo
+	lineNumber := 0
+	writeEntry := func() error {
+		info.entries++
+		currentLogEntry = append(currentLogEntry, '\n')
+		if _, err := out.Write(currentLogEntry); err != nil {
+			return fmt.Errorf("error writing output: %v", err)
+		}
+		return nil
+	}
+
+	for {
+		// Large files are abandoned mid-way when the run is cancelled
+		if lineNumber%cancelCheckLines == 0 && p.ctx.Err() != nil {
+			return info, p.ctx.Err()
+		}
+		line, err := reader.next()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return info, fmt.Errorf("error reading line %d: %v", lineNumber+1, err)
+		}
+		if err != nil && len(line) == 0 {
+			break
+		}
+		// At EOF line still holds the last line if it has no newline
+		atEOF := err != nil
+		lineNumber++
+		info.lines++
+		info.bytes += int64(len(line)) + reader.cut
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			info.endings.CRLF++
+		} else if bytes.HasSuffix(line, []byte("\n")) {
+			info.endings.LF++
+		}
+		if reader.cut > 0 {
+			info.longLines = append(info.longLines, lineNumber)
+			if p.opts.LongLines == "drop" {
+				if atEOF {
+					break
+				}
+				continue
+			}
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if p.opts.LineTransform != nil {
+			line = []byte(p.opts.LineTransform(name, string(line)))
+		}
+
+		var loc []int
+		if p.mixed != nil {
+			// The first format that matches and parses, not the leftmost
+			loc = p.findTimestamp(compiledRegex, string(line))
+		} else {
+			loc = compiledRegex.FindIndex(line)
+		}
+		startsEntry := loc != nil
+		if p.opts.ContinuationRule == "indent" {
+			startsEntry = !isContinuation(line)
+		}
+		if startsEntry {
+			if len(currentLogEntry) > 0 {
+				if err := writeEntry(); err != nil {
+					return info, err
+				}
+			}
+			currentLogEntry = currentLogEntry[:0]
+			// Only the indent rule starts entries without a timestamp
+			if loc == nil {
+				currentLogEntry = appendEscaped(currentLogEntry, line, delimiter)
+			} else {
+				value := string(line[loc[0]:loc[1]])
+				marker := ""
+				if p.opts.DateLayout == "" && isYearless(value) {
+					marker = fmt.Sprintf("%s%04d", yearMarker, years.next(value))
+					value = marker + value
+				}
+				if ts, err := parseTimestamp(value, p.opts.DateLayout); err != nil {
+					info.parseErrors = append(info.parseErrors, ParseError{File: name, Line: lineNumber, Text: string(line), Err: err})
+				} else {
+					if info.earliest.IsZero() || ts.Before(info.earliest) {
+						info.earliest = ts
+					}
+					if info.latest.IsZero() || ts.After(info.latest) {
+						info.latest = ts
+					}
+				}
+				if p.opts.AnnotateSource || p.opts.Format == "json" {
+					// After the timestamp, so the pattern still finds it and
+					// only the header line of a multi-line entry carries the
+					// tag.
+					line = slices.Concat(line[:loc[1]], []byte(" ["+filepath.Base(name)+"]"), line[loc[1]:])
+				}
+				if marker != "" {
+					// Added after escaping, which would double its escapeByte
+					currentLogEntry = appendEscaped(currentLogEntry, line[:loc[0]], delimiter)
+					currentLogEntry = append(currentLogEntry, marker...)
+					currentLogEntry = appendEscaped(currentLogEntry, line[loc[0]:], delimiter)
+				} else {
+					currentLogEntry = appendEscaped(currentLogEntry, line, delimiter)
+				}
+			}
+		} else if len(currentLogEntry) > 0 {
+			currentLogEntry = append(currentLogEntry, delimiter...)
+			currentLogEntry = appendEscaped(currentLogEntry, line, delimiter)
+		}
+		if atEOF {
+			break
+		}
+	}
+
+	// Write the last collected entry if any
+	if len(currentLogEntry) > 0 {
+		if err := writeEntry(); err != nil {
+			return info, err
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return info, fmt.Errorf("error writing output: %v", err)
+	}
+	return info, nil
+}
+
+// lineReader reads lines like bufio.Reader.ReadString('\n'), but into a
+// buffer reused from one line to the next. With max set, a line is cut after
+// max bytes (not counting its terminator) while it is read, so no line costs
+// more memory than that.
+type lineReader struct {
+	r   *bufio.Reader
+	buf []byte
+	max int
+	cut int64 // bytes cut from the last line
+}
+
+// next returns the next line with its terminator, or the last line without
+// one together with io.EOF. The line is only valid until the next call.
+func (l *lineReader) next() ([]byte, error) {
+	l.buf = l.buf[:0]
+	l.cut = 0
+	for {
+		chunk, err := l.r.ReadSlice('\n')
+		full := errors.Is(err, bufio.ErrBufferFull)
+		if l.max > 0 && len(l.buf)+len(chunk) > l.max {
+			return l.truncate(chunk, full, err)
+		}
+		if full {
+			// A line longer than the reader's buffer
+			l.buf = append(l.buf, chunk...)
+			continue
+		}
+		if len(l.buf) == 0 {
+			return chunk, err
+		}
+		l.buf = append(l.buf, chunk...)
+		return l.buf, err
+	}
+}
+
+// truncate continues next for a line that may exceed max, reading the rest
+// of it but only keeping max bytes and the terminator.
+func (l *lineReader) truncate(chunk []byte, full bool, err error) ([]byte, error) {
+	for {
+		var terminator []byte
+		if !full {
+			text := bytes.TrimSuffix(bytes.TrimSuffix(chunk, []byte("\n")), []byte("\r"))
+			chunk, terminator = text, chunk[len(text):]
+		}
+		room := min(max(l.max-len(l.buf), 0), len(chunk))
+		l.buf = append(l.buf, chunk[:room]...)
+		l.cut += int64(len(chunk) - room)
+		if !full {
+			return append(l.buf, terminator...), err
+		}
+		chunk, err = l.r.ReadSlice('\n')
+		full = errors.Is(err, bufio.ErrBufferFull)
+	}
+}
+
+// isContinuation reports whether line continues the entry before it under the
+// "indent" ContinuationRule.
+func isContinuation(line []byte) bool {
+	return len(line) == 0 || line[0] == ' ' || line[0] == '\t'
+}
+
+// Log text containing the delimiter is escaped so that splitting an entry on
+// it only ever separates the lines processLogStream joined: escapeByte becomes
+// escapeByte+escapeByte and the delimiter becomes escapeByte+escapedDelimiter.
+const (
+	escapeByte       = "\x1a"
+	escapedDelimiter = "\x1b"
+)
+
+// appendEscaped appends line, escaped as escapeDelimiter does, to dst.
+func appendEscaped(dst, line []byte, delimiter string) []byte {
+	if !bytes.Contains(line, []byte(escapeByte)) && !bytes.Contains(line, []byte(delimiter)) {
+		return append(dst, line...)
+	}
+	return append(dst, escapeDelimiter(string(line), delimiter)...)
+}
+
+// escapeDelimiter escapes line for joining with delimiter.
+func escapeDelimiter(line, delimiter string) string {
+	if !strings.Contains(line, escapeByte) && !strings.Contains(line, delimiter) {
+		return line
+	}
+	return strings.NewReplacer(escapeByte, escapeByte+escapeByte, delimiter, escapeByte+escapedDelimiter).Replace(line)
+}
+
+// splitEntry splits a joined entry back into its original lines.
+func splitEntry(entry, delimiter string) []string {
+	lines := strings.Split(entry, delimiter)
+	for i, line := range lines {
+		if strings.Contains(line, escapeByte) {
+			lines[i] = unescapeDelimiter(line, delimiter)
+		}
+	}
+	return lines
+}
+
+// unescapeDelimiter reverses escapeDelimiter, and drops yearMarkers and
+// tsMarkers.
+func unescapeDelimiter(line, delimiter string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(line, escapeByte)
+		if i < 0 || i+1 >= len(line) {
+			b.WriteString(line)
+			return b.String()
+		}
+		b.WriteString(line[:i])
+		switch {
+		case strings.HasPrefix(line[i:], tsMarker):
+			if end := strings.Index(line[i+len(tsMarker):], tsMarker); end >= 0 {
+				line = strings.TrimPrefix(line[i+2*len(tsMarker)+end:], " ")
+				continue
+			}
+		case strings.HasPrefix(line[i:], yearMarker):
+			line = line[min(i+len(yearMarker)+4, len(line)):]
+			continue
+		case line[i+1:i+2] == escapedDelimiter:
+			b.WriteString(delimiter)
+		default:
+			b.WriteString(escapeByte)
+		}
+		line = line[i+2:]
+	}
+}
+
+// determineDateTimePattern detects the timestamp pattern of filePath. input
+// is set for original log files, which are decoded as Encoding says;
+// intermediate files are always UTF-8.
+func (p *pipeline) determineDateTimePattern(filePath string, input bool) string {
+	open := p.openLogFile
+	if input {
+		open = p.openInput
+	}
+	f, err := open(filePath)
+	if err != nil {
+		p.log.Errorf("opening file for date pattern detection: %v", err)
+		return ""
+	}
+	defer f.Close()
+
+	return p.detectDateTimePattern(f)
+}
+
+// detectDateTimePattern returns the pattern of the first active format (see
+// Options.Formats) found in the first DetectLines non-blank lines of r, or ""
+// if none matches. Timestamps without fractional seconds fit both comma-ms
+// and dot-ms, so they only decide when no other timestamp is found.
+func (p *pipeline) detectDateTimePattern(r io.Reader) string {
+	if p.opts.DatePattern != "" {
+		return p.anchored(p.opts.DatePattern)
+	}
+
+	detect := p.formatPatterns()
+	regexes := make([]*regexp.Regexp, len(detect))
+	for i, pattern := range detect {
+		regexes[i] = regexp.MustCompile(p.anchored(pattern))
+	}
+
+	// A lineReader rather than a Scanner, so a line of any length (e.g. one
+	// huge JSON document) is still checked, by its first MaxLineBytes,
+	// instead of ending detection early.
+	reader := lineReader{r: bufio.NewReader(r), max: int(p.opts.MaxLineBytes)}
+	seconds := "" // a seconds-only timestamp was found, but no format yet
+	for checked := 0; checked < p.opts.DetectLines; {
+		line, err := reader.next()
+		if err != nil && len(line) == 0 {
+			break
+		}
+		// Blank lines (e.g. around a banner) do not count towards the limit
+		if len(bytes.TrimSpace(line)) != 0 {
+			for i, regex := range regexes {
+				if !regex.Match(line) {
+					continue
+				}
+				if detect[i] != secondsPattern {
+					return p.anchored(p.filePattern(detect[i]))
+				}
+				seconds = p.anchored(p.filePattern(secondsPattern))
+				break
+			}
+			checked++
+		}
+		if err != nil {
+			break
+		}
+	}
+	return seconds
+}
+
+// orderingPattern returns the pattern used to order and format the merged
+// stream. Inputs may each use a different built-in format, so once any
+// timestamp was detected all the active ones are matched.
+func (p *pipeline) orderingPattern(detected string) string {
+	if detected != "" && p.opts.DatePattern != "" && p.opts.FallbackModTime {
+		// FallbackModTime entries are marked whatever the pattern
+		return "(?:" + detected + ")|(?:" + p.anchored(markedPattern) + ")"
+	}
+	if detected == "" || p.opts.DatePattern != "" {
+		return detected
+	}
+	return p.anchored("(?:" + strings.Join(p.formatPatterns(), ")|(?:") + ")")
+}
+
+// anchored returns pattern restricted to the start of a line when Anchor is
+// set.
+func (p *pipeline) anchored(pattern string) string {
+	if !p.opts.Anchor || pattern == "" {
+		return pattern
+	}
+	return "^(?:" + pattern + ")"
+}
@@ -0,0 +1,143 @@
+package logmerge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// newTestPipeline returns a pipeline with the DefaultOptions of dir, changed
+// by configure when set.
+func newTestPipeline(t testing.TB, dir string, configure func(*Options)) *pipeline {
+	t.Helper()
+	opts := DefaultOptions(dir)
+	if configure != nil {
+		configure(&opts)
+	}
+	p, err := newPipeline(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// readFile returns the content of the file at path.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// processString runs processLogStream on input with the pattern of the
+// comma-ms format and returns the processed entries.
+func processString(t *testing.T, p *pipeline, input string) []string {
+	t.Helper()
+	var out strings.Builder
+	if _, err := p.processLogStream("test.log", strings.NewReader(input), &out, regexp.MustCompile(commaPattern), "\x00", 2023); err != nil {
+		t.Fatal(err)
+	}
+	return strings.SplitAfter(out.String(), "\n")
+}
+
+func TestDetectPatternAfterLongFirstLine(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "big.log")
+	first := "2023-06-01 10:00:00,000 INFO " + strings.Repeat("x", 2<<20) + "\n"
+	if err := os.WriteFile(path, []byte(first+"2023-06-01 10:00:01,000 INFO next\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPipeline(t, dir, nil)
+	if got := p.determineDateTimePattern(path, true); got != p.filePattern(commaPattern) {
+		t.Fatalf("detected %q, want the comma-ms pattern", got)
+	}
+	entries := processString(t, p, readFile(t, path))
+	if len(entries) != 3 || entries[0] != first || entries[2] != "" {
+		t.Errorf("got %d entries, want the long line and the next one", len(entries)-1)
+	}
+}
+
+func TestDetectPatternWithinMaxLineBytes(t *testing.T) {
+	// The long first line is only kept up to MaxLineBytes, which still holds
+	// its timestamp
+	input := "2023-06-01 10:00:00,000 INFO " + strings.Repeat("x", 2<<20) + "\n"
+	p := newTestPipeline(t, t.TempDir(), func(opts *Options) { opts.MaxLineBytes = 1 << 10 })
+	if got := p.detectDateTimePattern(strings.NewReader(input)); got != p.filePattern(commaPattern) {
+		t.Fatalf("detected %q, want the comma-ms pattern", got)
+	}
+}
+
+func TestLastLineWithoutNewline(t *testing.T) {
+	p := newTestPipeline(t, t.TempDir(), nil)
+	tests := []struct {
+		name, input string
+		want        []string
+	}{
+		{"entry", "2023-06-01 10:00:00,000 INFO a\n2023-06-01 10:00:01,000 INFO b",
+			[]string{"2023-06-01 10:00:00,000 INFO a\n", "2023-06-01 10:00:01,000 INFO b\n", ""}},
+		{"continuation", "2023-06-01 10:00:00,000 ERROR a\n\tat Main.run(Main.java:1)",
+			[]string{"2023-06-01 10:00:00,000 ERROR a\x00\tat Main.run(Main.java:1)\n", ""}},
+	}
+	for _, tt := range tests {
+		if got := processString(t, p, tt.input); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// BenchmarkProcessLogStream joins a synthetic log of 100,000 entries, one in
+// ten with a two-line stack trace, into processed entries.
+func TestMergeStopsWhenCancelled(t *testing.T) {
+	dir := t.TempDir()
+	var inputs []string
+	for i := 0; i < 2; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("%d.log", i))
+		if err := os.WriteFile(path, []byte("2023-06-01 10:00:00,000 INFO line\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, path)
+	}
+	p := newTestPipeline(t, dir, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.ctx = ctx
+	out := filepath.Join(dir, "MERGED.log")
+	if err := p.mergeProcessedLogs(inputs, out); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("merged file was left behind: %v", err)
+	}
+}
+
+func BenchmarkProcessLogStream(b *testing.B) {
+	var input strings.Builder
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&input, "2023-06-01 %02d:%02d:%02d,%03d INFO [worker-%d] request %d handled in %dms\n",
+			i/3600000%24, i/60000%60, i/1000%60, i%1000, i%8, i, i%250)
+		if i%10 == 0 {
+			input.WriteString("java.lang.IllegalStateException: retry\n\tat com.example.Handler.run(Handler.java:42)\n")
+		}
+	}
+	data := input.String()
+
+	p := newTestPipeline(b, b.TempDir(), nil)
+	regex := regexp.MustCompile(commaPattern)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.processLogStream("bench.log", strings.NewReader(data), io.Discard, regex, "\x00", 2023); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
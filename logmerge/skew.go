@@ -0,0 +1,55 @@
+package logmerge
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// reportSkew warns about inputs whose time ranges overlap another input's by
+// more than SkewThreshold. Logs that are meant to follow each other (e.g.
+// rotated files, or hosts taking turns) should barely overlap, so a large
+// overlap hints at clock skew and an unreliable interleaving. Each flagged file
+// is listed once, with the file it overlaps most. Output is not affected.
+func (p *pipeline) reportSkew(files []FileResult) {
+	if p.opts.SkewThreshold <= 0 {
+		return
+	}
+	type overlap struct {
+		file, other string
+		by          time.Duration
+	}
+	var flagged []overlap
+	for i, a := range files {
+		if a.Err != nil || a.Earliest.IsZero() {
+			continue
+		}
+		worst := overlap{file: a.Input}
+		for j, b := range files {
+			if i == j || b.Err != nil || b.Earliest.IsZero() {
+				continue
+			}
+			start, end := a.Earliest, a.Latest
+			if b.Earliest.After(start) {
+				start = b.Earliest
+			}
+			if b.Latest.Before(end) {
+				end = b.Latest
+			}
+			if by := end.Sub(start); by > worst.by {
+				worst.other, worst.by = b.Input, by
+			}
+		}
+		if worst.by > p.opts.SkewThreshold {
+			flagged = append(flagged, worst)
+		}
+	}
+	if len(flagged) == 0 {
+		return
+	}
+	var list strings.Builder
+	for _, o := range flagged {
+		fmt.Fprintf(&list, "\n  %s overlaps %s by %v", o.file, o.other, o.by)
+	}
+	p.log.Warnf("%d file(s) overlap another input by more than %v; if their clocks differ the merged order may be misleading:%s", len(flagged), p.opts.SkewThreshold, list.String())
+}
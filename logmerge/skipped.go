@@ -0,0 +1,87 @@
+package logmerge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// SkippedFileName lists the inputs a run left out and why; it is written in
+// the ProcessedLogs folder, after Prefix.
+const SkippedFileName = "skipped.json"
+
+// The reasons recorded in SkippedFile.
+const (
+	SkipExcluded     = "excluded"                  // left out by Include or Exclude
+	SkipLimit        = "limit-files"               // beyond LimitFiles
+	SkipDuplicate    = "duplicate name"            // OnCollision "skip"
+	SkipPermission   = "permission denied"         // while searching or opening
+	SkipUnreadable   = "unreadable"                // any other search error
+	SkipEmpty        = "empty"                     // SkipEmpty
+	SkipUnrecognized = "unrecognized date pattern" // no timestamp format detected
+	SkipFailed       = "failed"                    // any other processing error
+)
+
+// SkippedFile is an input left out of a run, in skipped.json. Path is a folder
+// when a whole folder could not be searched.
+type SkippedFile struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"` // the error behind it, if any
+}
+
+// errUnrecognizedPattern is wrapped by the error of an input whose timestamp
+// format could not be detected.
+var errUnrecognizedPattern = errors.New("unrecognized date pattern")
+
+// skip records path as left out for reason, because of err when not nil.
+func (p *pipeline) skip(path, reason string, err error) {
+	s := SkippedFile{Path: path, Reason: reason}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	p.skipped = append(p.skipped, s)
+}
+
+// skipUnreadable records a path the search could not read, from its error.
+func (p *pipeline) skipUnreadable(err error) {
+	path := ""
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		path = pathErr.Path
+	}
+	reason := SkipUnreadable
+	if errors.Is(err, fs.ErrPermission) {
+		reason = SkipPermission
+	}
+	p.skip(path, reason, err)
+}
+
+// skipFailed records the input of f, which could not be processed.
+func (p *pipeline) skipFailed(f FileResult) {
+	reason := SkipFailed
+	switch {
+	case errors.Is(f.Err, errUnrecognizedPattern):
+		reason = SkipUnrecognized
+	case errors.Is(f.Err, fs.ErrPermission):
+		reason = SkipPermission
+	}
+	p.skip(f.Input, reason, f.Err)
+}
+
+// writeSkipped writes skipped to path as a JSON array.
+func writeSkipped(path string, skipped []SkippedFile) error {
+	if skipped == nil {
+		skipped = []SkippedFile{}
+	}
+	data, err := json.MarshalIndent(skipped, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %v", SkippedFileName, err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing %s: %v", SkippedFileName, err)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package logmerge
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// unmatchedGroup names the stream of the entries SplitBy does not match.
+const unmatchedGroup = "unmatched"
+
+// groupName keeps the characters of a SplitBy group that are safe in a file
+// name and replaces the others with "_".
+var groupName = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// entryGroup returns the SplitBy stream of the intermediate entry raw, found
+// in its first line.
+func (p *pipeline) entryGroup(raw, delimiter string) string {
+	header, _, _ := strings.Cut(raw, delimiter)
+	match := p.splitRegex.FindStringSubmatch(unescapeDelimiter(header, delimiter))
+	if match == nil || match[1] == "" {
+		return unmatchedGroup
+	}
+	return groupName.ReplaceAllString(match[1], "_")
+}
+
+// splitProcessed splits each processed file into one file per SplitBy stream,
+// named after it (app.log gives app-auth.log, app-db.log, ...), and removes
+// it. It returns the stream files, those of one input sorted by stream; on
+// error they are returned together with the inputs not yet split, for
+// removal.
+func (p *pipeline) splitProcessed(processedLogFiles []string, delimiter string) ([]string, error) {
+	var split []string
+	for i, processed := range processedLogFiles {
+		paths, err := p.splitFile(processed, delimiter)
+		split = append(split, paths...)
+		if err != nil {
+			return append(split, processedLogFiles[i:]...), err
+		}
+		os.Remove(processed)
+	}
+	return split, nil
+}
+
+// splitFile writes the entries of the processed file at path to the files of
+// their streams. Streams stay open as long as MaxOpenFiles allows; otherwise
+// one is closed to make room and appended to when needed again.
+func (p *pipeline) splitFile(path, delimiter string) ([]string, error) {
+	defer p.files.release(p.files.acquire(1))
+	inFile, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file %s: %v", path, err)
+	}
+	defer inFile.Close()
+
+	type stream struct {
+		file *os.File
+		w    *bufio.Writer
+	}
+	streams := make(map[string]*stream)
+	names := make(map[string]string) // of every stream, open or not
+	var paths []string
+	closeStream := func(group string) error {
+		s := streams[group]
+		delete(streams, group)
+		defer p.files.release(1)
+		err := s.w.Flush()
+		if closeErr := s.file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+	closeAll := func() error {
+		var firstErr error
+		for group := range streams {
+			if err := closeStream(group); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	ext := filepath.Ext(path)
+	reader := bufio.NewReader(inFile)
+	for {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			closeAll()
+			return paths, fmt.Errorf("error reading %s: %v", path, readErr)
+		}
+		if line != "" {
+			group := p.entryGroup(strings.TrimSuffix(line, "\n"), delimiter)
+			s := streams[group]
+			if s == nil {
+				// Besides the streams, the processed file is open
+				for open := range streams {
+					if len(streams) < p.files.size-1 {
+						break
+					}
+					if err := closeStream(open); err != nil {
+						closeAll()
+						return paths, fmt.Errorf("error writing output: %v", err)
+					}
+				}
+				s = &stream{}
+				name, seen := names[group]
+				var err error
+				if seen {
+					s.file, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0666)
+				} else if name, err = getUniqueFileName(strings.TrimSuffix(path, ext) + "-" + group + ext); err == nil {
+					s.file, err = os.Create(name)
+				}
+				if err != nil {
+					closeAll()
+					return paths, fmt.Errorf("error creating output file for stream %s: %v", group, err)
+				}
+				p.files.acquire(1)
+				s.w = bufio.NewWriter(s.file)
+				streams[group] = s
+				if !seen {
+					names[group] = name
+					paths = append(paths, name)
+				}
+			}
+			if _, err := s.w.WriteString(line); err != nil {
+				closeAll()
+				return paths, fmt.Errorf("error writing output: %v", err)
+			}
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	if err := closeAll(); err != nil {
+		return paths, fmt.Errorf("error writing output: %v", err)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
@@ -0,0 +1,151 @@
+package logmerge
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The functions below run a single pipeline step so steps can be repeated or
+// combined without running everything, e.g. to re-sort a merged file with a
+// different pattern. Options not used by a step are ignored.
+
+// ProcessFile joins the multi-line entries of the log at in into single lines
+// written to out, the input format of Merge and Order.
+func ProcessFile(in, out string, opts Options) error {
+	p, err := newPipeline(opts)
+	if err != nil {
+		return err
+	}
+	info, err := p.processLogFile(in, out, opts.Delimiter)
+	if err != nil {
+		return err
+	}
+	if len(info.parseErrors) > 0 {
+		if opts.StrictTimestamps {
+			return fmt.Errorf("%w: %v", ErrMalformedTimestamp, info.parseErrors[0])
+		}
+		for _, e := range info.parseErrors {
+			p.log.Warnf("%v", e)
+		}
+	}
+	for _, line := range info.longLines {
+		p.log.Warnf("%s:%d: line longer than %d bytes was %s", in, line, opts.MaxLineBytes, longLineAction(opts))
+	}
+	return nil
+}
+
+// Merge concatenates processed files, in the given order, into out.
+func Merge(inputs []string, out string, opts Options) error {
+	p, err := newPipeline(opts)
+	if err != nil {
+		return err
+	}
+	return p.mergeProcessedLogs(inputs, out)
+}
+
+// Order sorts the processed or merged file at in by timestamp into out,
+// applying the time window, level, dedup, tail and reverse options. Without
+// DatePattern the timestamp format is detected from in.
+func Order(in, out string, opts Options) error {
+	p, err := newPipeline(opts)
+	if err != nil {
+		return err
+	}
+	pattern, err := p.stagePattern(in)
+	if err != nil {
+		return err
+	}
+	return p.orderByDate(in, out, pattern, opts.Delimiter)
+}
+
+// Format splits the entries of the ordered file at in back into their original
+// lines, or writes them as JSON, into out, or into the files of Bucket or
+// SplitOutputs derived from out. EOL "auto" writes "\n" here since the
+// original line endings are not known.
+func Format(in, out string, opts Options) error {
+	p, err := newPipeline(opts)
+	if err != nil {
+		return err
+	}
+	pattern, err := p.stagePattern(in)
+	if err != nil {
+		return err
+	}
+	p.eol = chooseEOL(opts.EOL, lineEndings{})
+	if opts.Bucket != "" || opts.SplitOutputs {
+		_, err := p.formatBuckets(in, out, pattern, opts.Delimiter)
+		return err
+	}
+	return p.formatSupport(in, out, pattern, opts.Delimiter)
+}
+
+// Validate checks that the timestamps starting the lines of the output file at
+// in never decrease, or never increase with Reverse, and returns how many it
+// parsed. The first one out of order is reported as an error wrapping
+// ErrUnordered. Lines without a timestamp, such as the continuation lines of
+// an entry, are skipped, and so are timestamps that cannot be parsed. in may
+// be gzip-compressed and in any Encoding.
+func Validate(in string, opts Options) (int, error) {
+	p, err := newPipeline(opts)
+	if err != nil {
+		return 0, err
+	}
+	pattern := p.orderingPattern(p.determineDateTimePattern(in, true))
+	if pattern == "" {
+		return 0, fmt.Errorf("unrecognized date pattern in %s", in)
+	}
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return 0, fmt.Errorf("failed to compile regex pattern: %v", err)
+	}
+	f, err := p.openInput(in)
+	if err != nil {
+		return 0, fmt.Errorf("error opening file: %v", err)
+	}
+	defer f.Close()
+
+	// Year-less timestamps get their years as when processing, counting
+	// from a leap year so that Feb 29 parses
+	years := yearTracker{year: 2000}
+	var previous time.Time
+	entries, previousLine := 0, 0
+	reader := lineReader{r: bufio.NewReader(f), max: int(opts.MaxLineBytes)}
+	for lineNumber := 1; ; lineNumber++ {
+		raw, readErr := reader.next()
+		line := string(raw)
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return entries, fmt.Errorf("error reading line %d: %v", lineNumber, readErr)
+		}
+		if span := p.findTimestamp(regex, line); span != nil {
+			value := line[span[0]:span[1]]
+			if opts.DateLayout == "" && isYearless(value) && !opts.Reverse {
+				value = fmt.Sprintf("%s%04d", yearMarker, years.next(value)) + value
+			}
+			if ts, err := parseTimestamp(value, opts.DateLayout); err == nil {
+				if entries > 0 && (ts.Before(previous) && !opts.Reverse || ts.After(previous) && opts.Reverse) {
+					return entries, fmt.Errorf("%w: line %d (%s) comes after line %d (%s): %s", ErrUnordered,
+						lineNumber, ts.Format(time.RFC3339Nano), previousLine, previous.Format(time.RFC3339Nano), strings.TrimRight(line, "\r\n"))
+				}
+				previous, previousLine = ts, lineNumber
+				entries++
+			}
+		}
+		if readErr != nil {
+			return entries, nil
+		}
+	}
+}
+
+// stagePattern returns the ordering pattern for a file given to a single step.
+func (p *pipeline) stagePattern(path string) (string, error) {
+	pattern := p.orderingPattern(p.determineDateTimePattern(path, false))
+	if pattern == "" {
+		return "", fmt.Errorf("unrecognized date pattern in %s", path)
+	}
+	return pattern, nil
+}
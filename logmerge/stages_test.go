@@ -0,0 +1,137 @@
+package logmerge_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/NL-Cristi/MergeOrderLog/logmerge"
+)
+
+const (
+	apiNode1 = "2023-06-01 10:00:00,000 INFO node1 started\n" +
+		"2023-06-01 10:00:02,000 ERROR node1 failed\n" +
+		"\tat com.example.Node.run(Node.java:7)\n"
+	apiNode2 = "2023-06-01 10:00:01,000 INFO node2 started\n"
+	apiWant  = "2023-06-01 10:00:00,000 INFO node1 started\n" +
+		"2023-06-01 10:00:01,000 INFO node2 started\n" +
+		"2023-06-01 10:00:02,000 ERROR node1 failed\n" +
+		"\tat com.example.Node.run(Node.java:7)\n"
+)
+
+func TestProcess(t *testing.T) {
+	dir := t.TempDir()
+	writeLog(t, dir, "node1.log", apiNode1)
+	writeLog(t, dir, "node2.log", apiNode2)
+	result, got := run(t, logmerge.DefaultOptions(dir))
+	if got != apiWant {
+		t.Errorf("got:\n%s\nwant:\n%s", got, apiWant)
+	}
+	if len(result.Files) != 2 || result.Failed != 0 {
+		t.Errorf("got %d file(s), %d failed; want 2, 0", len(result.Files), result.Failed)
+	}
+	if result.Stats.Entries != 3 {
+		t.Errorf("got %d entries, want 3", result.Stats.Entries)
+	}
+}
+
+func TestStepsMatchProcess(t *testing.T) {
+	dir := t.TempDir()
+	opts := logmerge.DefaultOptions(dir)
+	var processed []string
+	for name, content := range map[string]string{"node1.log": apiNode1, "node2.log": apiNode2} {
+		out := filepath.Join(dir, name+".processed")
+		if err := logmerge.ProcessFile(writeLog(t, dir, name, content), out, opts); err != nil {
+			t.Fatalf("ProcessFile: %v", err)
+		}
+		processed = append(processed, out)
+	}
+	merged := filepath.Join(dir, "merged")
+	if err := logmerge.Merge(processed, merged, opts); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	ordered := filepath.Join(dir, "ordered")
+	if err := logmerge.Order(merged, ordered, opts); err != nil {
+		t.Fatalf("Order: %v", err)
+	}
+	final := filepath.Join(dir, "final")
+	if err := logmerge.Format(ordered, final, opts); err != nil {
+		t.Fatalf("Format: %v", err)
+	}
+	if got := readFile(t, final); got != apiWant {
+		t.Errorf("got:\n%s\nwant:\n%s", got, apiWant)
+	}
+	if n, err := logmerge.Validate(final, opts); err != nil || n != 3 {
+		t.Errorf("Validate: %d, %v; want 3, nil", n, err)
+	}
+}
+
+func TestProcessStream(t *testing.T) {
+	var out strings.Builder
+	if err := logmerge.ProcessStream(strings.NewReader(apiNode1+apiNode2), &out, logmerge.DefaultOptions("")); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != apiWant {
+		t.Errorf("got:\n%s\nwant:\n%s", got, apiWant)
+	}
+}
+
+func TestMixedMillisecondsAndSeconds(t *testing.T) {
+	dir := t.TempDir()
+	writeLog(t, dir, "a.log", "2023-06-01 10:00:01 INFO a seconds\n"+
+		"2023-06-01 10:00:01,500 INFO a ms\n"+
+		"2023-06-01 10:00:03 INFO a seconds again\n")
+	writeLog(t, dir, "b.log", "2023-06-01 10:00:00,250 INFO b ms\n"+
+		"2023-06-01 10:00:02 INFO b seconds\n")
+	// A seconds-only timestamp is at .000, so it sorts before 10:00:01,500
+	want := "2023-06-01 10:00:00,250 INFO b ms\n" +
+		"2023-06-01 10:00:01 INFO a seconds\n" +
+		"2023-06-01 10:00:01,500 INFO a ms\n" +
+		"2023-06-01 10:00:02 INFO b seconds\n" +
+		"2023-06-01 10:00:03 INFO a seconds again\n"
+	result, got := run(t, logmerge.DefaultOptions(dir))
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if result.Stats.Entries != 5 {
+		t.Errorf("got %d entries, want 5", result.Stats.Entries)
+	}
+}
+
+func TestMixedFormatsInOneFile(t *testing.T) {
+	dir := t.TempDir()
+	// comma-ms for the first service, iso8601 for the second
+	writeLog(t, dir, "all.log", "2023-06-01 10:00:00,000 INFO first service up\n"+
+		"2023-06-01 10:00:03,000 ERROR first service failed\n"+
+		"\tat com.example.First.run(First.java:7)\n"+
+		"2023-06-01T10:00:01.000Z INFO second service up\n"+
+		"2023-06-01T10:00:02.000Z INFO second service ready\n")
+	tests := []struct {
+		mixed bool
+		want  string
+	}{
+		// Only the detected format starts an entry, so the iso8601 lines
+		// stay in the trace of the last comma-ms entry
+		{false, "2023-06-01 10:00:00,000 INFO first service up\n" +
+			"2023-06-01 10:00:03,000 ERROR first service failed\n" +
+			"\tat com.example.First.run(First.java:7)\n" +
+			"2023-06-01T10:00:01.000Z INFO second service up\n" +
+			"2023-06-01T10:00:02.000Z INFO second service ready\n"},
+		{true, "2023-06-01 10:00:00,000 INFO first service up\n" +
+			"2023-06-01T10:00:01.000Z INFO second service up\n" +
+			"2023-06-01T10:00:02.000Z INFO second service ready\n" +
+			"2023-06-01 10:00:03,000 ERROR first service failed\n" +
+			"\tat com.example.First.run(First.java:7)\n"},
+	}
+	for _, tt := range tests {
+		opts := logmerge.DefaultOptions(dir)
+		opts.MixedFormats = tt.mixed
+		result, got := run(t, opts)
+		if got != tt.want {
+			t.Errorf("mixed %v:\n%s\nwant:\n%s", tt.mixed, got, tt.want)
+		}
+		if result.Failed != 0 {
+			t.Errorf("mixed %v: %d file(s) failed", tt.mixed, result.Failed)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package logmerge
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// dateLayoutDefault matches 2023-06-01 12:34:56; commas are normalized to
+	// dots, and the fractional seconds and UTC offset found in each timestamp
+	// are appended to the layout before parsing (see timestampLayout).
+	dateLayoutDefault = "2006-01-02 15:04:05"
+	// commaPattern and dotPattern match 12:34:56,789 and 12:34:56.789, as
+	// well as microsecond and nanosecond fractions, optionally followed by an
+	// offset such as Z, +02:00 or -0500.
+	commaPattern = `\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2},\d{3}(?:\d{3}){0,2}(?:Z|[+-]\d{2}:?\d{2})?`
+	dotPattern   = `\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}\.\d{3}(?:\d{3}){0,2}(?:Z|[+-]\d{2}:?\d{2})?`
+	// secondsPattern matches 2023-06-01 12:34:56 without fractional seconds,
+	// which files in the comma-ms and dot-ms formats may mix in; such a
+	// timestamp parses as .000. It is only tried after the other formats, so
+	// it never takes the seconds of one that has a fraction.
+	secondsPattern = `\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}(?:Z|[+-]\d{2}:?\d{2})?`
+	// dateLayoutISO/isoPattern match ISO-8601 timestamps such as
+	// 2023-06-01T12:34:56.789Z; the fraction and offset are optional.
+	dateLayoutISO = "2006-01-02T15:04:05"
+	isoPattern    = `\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?`
+	// syslogPattern matches year-less syslog timestamps such as
+	// "Jun 01 12:34:56.789" or "Jun  1 12:34:56"; processLogStream gives them
+	// a year (see yearTracker) and records it in a yearMarker before them.
+	syslogPattern = `(?:\x1a\x1c\d{4})?(?:Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec) [ 0-3]\d \d{2}:\d{2}:\d{2}(?:[.,]\d+)?`
+)
+
+// timestampFormat is a built-in timestamp format: its name in
+// Options.Formats, the regex finding it and the Go layout of an example.
+// Parsing does not need the layout, as parseTimestamp recognizes every
+// built-in format by its shape.
+type timestampFormat struct {
+	name, pattern, layout string
+	// seconds is set for the formats whose timestamps may also come without
+	// fractional seconds (secondsPattern).
+	seconds bool
+}
+
+// timestampFormats are the built-in formats in their default detection order.
+var timestampFormats = []timestampFormat{
+	{"comma-ms", commaPattern, "2006-01-02 15:04:05,000", true},
+	{"dot-ms", dotPattern, "2006-01-02 15:04:05.000", true},
+	{"iso8601", isoPattern, "2006-01-02T15:04:05.000Z07:00", false},
+	{"syslog", syslogPattern, "Jan _2 15:04:05", false},
+}
+
+// filePattern returns the pattern finding the timestamps of a file in format
+// f, seconds-only ones included.
+func (f timestampFormat) filePattern() string {
+	if f.seconds {
+		return f.pattern + "|" + secondsPattern
+	}
+	return f.pattern
+}
+
+// selectFormats returns the built-in formats named in names, in that order,
+// or all of them when names is empty.
+func selectFormats(names []string) ([]timestampFormat, error) {
+	if len(names) == 0 {
+		return timestampFormats, nil
+	}
+	var formats []timestampFormat
+	selected := make(map[string]bool)
+	for _, name := range names {
+		found := false
+		for _, f := range timestampFormats {
+			if f.name == name {
+				found = true
+				if !selected[name] {
+					selected[name] = true
+					formats = append(formats, f)
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown --formats value %q; use comma-ms, dot-ms, iso8601 or syslog", name)
+		}
+	}
+	return formats, nil
+}
+
+// formatPatterns returns the patterns detection tries, in order: those of the
+// active formats, secondsPattern if one of them accepts it, then
+// markedPattern, which only JSONInput intermediates contain.
+func (p *pipeline) formatPatterns() []string {
+	patterns := make([]string, 0, len(p.formats)+2)
+	seconds := false
+	for _, f := range p.formats {
+		patterns = append(patterns, f.pattern)
+		seconds = seconds || f.seconds
+	}
+	if seconds {
+		patterns = append(patterns, secondsPattern)
+	}
+	return append(patterns, markedPattern)
+}
+
+// filePattern returns the pattern of the files in which detection found
+// pattern, one of formatPatterns: that of its format, or of the first active
+// format accepting seconds-only timestamps.
+func (p *pipeline) filePattern(pattern string) string {
+	for _, f := range p.formats {
+		if f.pattern == pattern || pattern == secondsPattern && f.seconds {
+			return f.filePattern()
+		}
+	}
+	return pattern
+}
+
+// yearMarker and the four-digit year after it precede a year-less timestamp
+// in the intermediates. Being an escape sequence (see escapeByte), it never
+// occurs in escaped log text and is dropped when entries are split again.
+const yearMarker = escapeByte + "\x1c"
+
+// isYearless reports whether a built-in timestamp value is in the year-less
+// syslog format; the other built-in formats start with the year.
+func isYearless(value string) bool {
+	return value != "" && (value[0] < '0' || value[0] > '9') && !strings.HasPrefix(value, tsMarker)
+}
+
+// parseYearless parses a syslog timestamp, taking the year from its
+// yearMarker. Without one the year is 0.
+func parseYearless(value string) (time.Time, error) {
+	year := "0000"
+	if strings.HasPrefix(value, yearMarker) && len(value) > len(yearMarker)+4 {
+		year, value = value[len(yearMarker):len(yearMarker)+4], value[len(yearMarker)+4:]
+	}
+	return time.Parse("2006 "+yearlessLayout(value), year+" "+value)
+}
+
+// yearlessLayout returns the layout of a syslog timestamp value, keeping its
+// day padding and as many fractional-second digits as value has.
+func yearlessLayout(value string) string {
+	if strings.HasPrefix(value, yearMarker) && len(value) > len(yearMarker)+4 {
+		value = value[len(yearMarker)+4:]
+	}
+	layout := "Jan _2 15:04:05"
+	if len(value) > 4 && value[4] != ' ' {
+		layout = "Jan 02 15:04:05"
+	}
+	if i := strings.LastIndexAny(value, ".,"); i >= 0 {
+		layout += value[i:i+1] + strings.Repeat("0", len(value)-i-1)
+	}
+	return layout
+}
+
+// yearTracker assigns years to the year-less timestamps of one file, read in
+// order. A month more than six months before the previous one, as in Dec 31
+// followed by Jan 01, starts the next year.
+type yearTracker struct {
+	year  int
+	month time.Month
+}
+
+// next returns the year of the timestamp value.
+func (y *yearTracker) next(value string) int {
+	if t, err := time.Parse("Jan", value[:3]); err == nil {
+		if y.month != 0 && t.Month() < y.month-6 {
+			y.year++
+		}
+		y.month = t.Month()
+	}
+	return y.year
+}
+
+// firstYear returns the year of the first year-less timestamp in r, so that
+// the last one falls in AssumeYear: each year boundary crossed in r moves the
+// start back a year.
+func (p *pipeline) firstYear(r io.Reader, regex *regexp.Regexp) int {
+	var years yearTracker
+	reader := lineReader{r: bufio.NewReader(r), max: int(p.opts.MaxLineBytes)}
+	for {
+		raw, err := reader.next()
+		line := string(raw)
+		if span := p.findTimestamp(regex, line); span != nil && isYearless(line[span[0]:span[1]]) {
+			years.next(line[span[0]:span[1]])
+		}
+		if err != nil {
+			break
+		}
+	}
+	return p.opts.AssumeYear - years.year
+}
+
+// ParseTimestamp parses a timestamp in the format of the log lines: with
+// layout "" any built-in format is accepted, otherwise value must match the
+// given Go time layout (see Options.DateLayout).
+func ParseTimestamp(value, layout string) (time.Time, error) {
+	return parseTimestamp(value, layout)
+}
+
+func (p *pipeline) parseTimestampFromLine(line string, regex *regexp.Regexp) (time.Time, error) {
+	span := p.findTimestamp(regex, line)
+	if span == nil {
+		return time.Time{}, fmt.Errorf("no timestamp found in line: %s", line)
+	}
+	return parseTimestamp(line[span[0]:span[1]], p.opts.DateLayout)
+}
+
+// findTimestamp returns the span of the timestamp regex finds in line, or
+// nil. With MixedFormats it is that of the first format, in priority order,
+// that matches and parses, or failing that of the first that matches; the
+// leftmost match of regex could be a date quoted in another format, or one
+// that only looks like a timestamp.
+func (p *pipeline) findTimestamp(regex *regexp.Regexp, line string) []int {
+	if p.mixed == nil {
+		return regex.FindStringIndex(line)
+	}
+	var first []int
+	for _, format := range p.mixed {
+		span := format.FindStringIndex(line)
+		if span == nil {
+			continue
+		}
+		if _, err := parseTimestamp(line[span[0]:span[1]], ""); err == nil {
+			return span
+		}
+		if first == nil {
+			first = span
+		}
+	}
+	return first
+}
+
+// parseTimestamp parses a timestamp matched by the date pattern. A non-empty
+// layout is the custom --dateLayout and is used as-is.
+func parseTimestamp(value, layout string) (time.Time, error) {
+	if strings.HasPrefix(value, tsMarker) {
+		return time.Parse(time.RFC3339Nano, strings.Trim(value, tsMarker))
+	}
+	if layout != "" {
+		return time.Parse(layout, value)
+	}
+	if isYearless(value) {
+		return parseYearless(value)
+	}
+	normalized := strings.Replace(value, ",", ".", 1)
+	parsed, err := time.Parse(timestampLayout(normalized, zoneLayout(normalized)), normalized)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parsed, nil
+}
+
+// timestampLayout builds the layout for a built-in timestamp: the date and
+// time, as many fractional-second digits as value has, then zone.
+func timestampLayout(value, zone string) string {
+	layout := dateLayoutDefault
+	if len(value) > 10 && value[10] == 'T' {
+		layout = dateLayoutISO
+	}
+	if digits := fractionDigits(value); digits > 0 {
+		layout += "." + strings.Repeat("0", digits)
+	}
+	return layout + zone
+}
+
+// fractionDigits counts the fractional-second digits of a normalized
+// timestamp (0 when it has none).
+func fractionDigits(value string) int {
+	if len(value) <= 19 || value[19] != '.' {
+		return 0
+	}
+	digits := 0
+	for _, c := range value[20:] {
+		if c < '0' || c > '9' {
+			break
+		}
+		digits++
+	}
+	return digits
+}
+
+var zoneSuffix = regexp.MustCompile(`(?:Z|[+-]\d{2}:?\d{2})$`)
+
+// zoneLayout returns the layout fragment for a trailing UTC offset in value,
+// or "" when the timestamp has none (it is then treated as UTC).
+func zoneLayout(value string) string {
+	switch zone := zoneSuffix.FindString(value); {
+	case zone == "":
+		return ""
+	case zone == "Z":
+		return "Z07:00"
+	case strings.Contains(zone, ":"):
+		return "-07:00"
+	default:
+		return "-0700"
+	}
+}
+
+// tsPrecisions maps the TSPrecision names to what timestamps are truncated to.
+var tsPrecisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// convertTimestamp rewrites the first timestamp in line to loc, or keeps its
+// zone when loc is nil. With normalize it is written in RFC 3339 instead of
+// its original format, truncated to precision. Lines whose timestamp can't be
+// parsed are returned unchanged.
+func convertTimestamp(line string, span []int, loc *time.Location, customLayout string, normalize bool, precision time.Duration) string {
+	if span == nil || strings.HasPrefix(line[span[0]:], tsMarker) {
+		// JSONInput entries are kept exactly as they were
+		return line
+	}
+	parsed, err := parseTimestamp(line[span[0]:span[1]], customLayout)
+	if err != nil {
+		return line
+	}
+	if loc != nil {
+		parsed = parsed.In(loc)
+	}
+	if normalize {
+		return line[:span[0]] + parsed.Truncate(precision).Format(time.RFC3339Nano) + line[span[1]:]
+	}
+	// Keep the original precision and style, with an explicit offset
+	match := strings.Replace(line[span[0]:span[1]], ",", ".", 1)
+	layout := timestampLayout(match, "-07:00")
+	switch {
+	case customLayout != "":
+		layout = customLayout
+	case isYearless(match):
+		// A year-less format has no room for an offset either
+		layout = yearlessLayout(match)
+	case len(match) > 10 && match[10] == 'T':
+		layout = timestampLayout(match, "Z07:00")
+	}
+	return line[:span[0]] + parsed.Format(layout) + line[span[1]:]
+}
+
+// inTimeWindow reports whether t falls within [From, To]. Without From, the
+// Since window starts at the current time less Since when zoned is set, and
+// otherwise at the same wall-clock time read as UTC, like t was.
+func (p *pipeline) inTimeWindow(t time.Time, zoned bool) bool {
+	from := p.opts.From
+	if from.IsZero() && !p.since.IsZero() {
+		from = p.since
+		if !zoned {
+			local := p.since.Local()
+			from = time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), local.Nanosecond(), time.UTC)
+		}
+	}
+	if !from.IsZero() && t.Before(from) {
+		return false
+	}
+	if !p.opts.To.IsZero() && t.After(p.opts.To) {
+		return false
+	}
+	return true
+}
+
+// hasZone reports whether value, a timestamp matched by the date pattern,
+// carries its UTC offset and so names an instant rather than a wall-clock
+// time. With a custom layout the layout decides; marked timestamps are
+// always instants.
+func hasZone(value, layout string) bool {
+	switch {
+	case strings.HasPrefix(value, tsMarker):
+		return true
+	case layout != "":
+		return strings.Contains(layout, "07") || strings.Contains(layout, "MST")
+	case isYearless(value):
+		return false
+	}
+	return zoneSuffix.MatchString(value)
+}
+
+// validateCustomDateFormat checks the DateLayout/DatePattern pair up front so
+// a bad value fails at startup instead of silently failing to parse every line.
+func validateCustomDateFormat(layout, pattern string) error {
+	if layout == "" && pattern == "" {
+		return nil
+	}
+	if layout == "" || pattern == "" {
+		return fmt.Errorf("--dateLayout and --datePattern must be used together")
+	}
+
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid --datePattern %q: %v", pattern, err)
+	}
+
+	// A layout without any reference-time elements renders as itself.
+	sample := time.Date(2006, time.January, 2, 15, 4, 5, 123456789, time.UTC).Format(layout)
+	if sample == layout {
+		return fmt.Errorf("invalid --dateLayout %q: no date or time elements found", layout)
+	}
+	if _, err := time.Parse(layout, sample); err != nil {
+		return fmt.Errorf("invalid --dateLayout %q: %v", layout, err)
+	}
+	if match := regex.FindString(sample); match == "" {
+		return fmt.Errorf("--datePattern %q does not match a timestamp in --dateLayout format (%q)", pattern, sample)
+	} else if _, err := time.Parse(layout, match); err != nil {
+		return fmt.Errorf("--datePattern %q does not capture a full --dateLayout timestamp: matched %q in %q", pattern, match, sample)
+	}
+	return nil
+}
@@ -2,457 +2,1456 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
+
+	"github.com/NL-Cristi/MergeOrderLog/logmerge"
 )
 
 var (
 	// Version is set at build time via ldflags: -X main.version=<VERSION>
-	version                   = "Dev"
-	dateLayoutDefault         = "2006-01-02 15:04:05.000" // matches 2023-06-01 12:34:56.789
-	dateLayoutSupport         = "2006-01-02 15:04:05.000" // can parse both . and , with a small tweak
-	defaultPattern            = `\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2},\d{3}`
-	supportPattern            = `\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}\.\d{3}`
-	lineContinuationDelimiter = "appTesting"
-	workerCount               = 5 // concurrency limit for processing logs
+	version = "Dev"
+	// buildDate is set the same way: -X main.buildDate=<DATE>
+	buildDate = ""
+
+	lineContinuationDelimiter = `\x00` // joins continuation lines (escaped form); override with --delimiter
+
+	// infoOut receives the diagnostics, which always go to stderr so stdout
+	// only carries results: the --stdin output, --stats-json -, --preview, the
+	// --dry-run and --count-only listings and the validate and diff reports.
+	infoOut = &logger{text: logmerge.TextLogger(os.Stderr), out: os.Stderr}
 )
 
-// LogLine holds a parsed timestamp and the raw text of the log line.
-type LogLine struct {
-	Timestamp time.Time
-	Raw       string
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// logger is the logmerge.Logger of every run and also carries this
+// command's own messages to stderr: as logmerge.TextLogger writes them, or
+// with --log-format json as one object per message holding the time, the
+// level and the message.
+type logger struct {
+	text logmerge.Logger
+	mu   sync.Mutex
+	out  io.Writer
+	json bool
+}
+
+// logRecord is one --log-format json message.
+type logRecord struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+}
+
+// setFormat switches the logger to the --log-format named by format.
+func (l *logger) setFormat(format string) error {
+	switch format {
+	case "text", "json":
+	default:
+		return fmt.Errorf("--log-format must be text or json, not %q", format)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.json = format == "json"
+	return nil
+}
+
+func (l *logger) Infof(format string, args ...any)  { l.log("info", l.text.Infof, format, args...) }
+func (l *logger) Warnf(format string, args ...any)  { l.log("warning", l.text.Warnf, format, args...) }
+func (l *logger) Errorf(format string, args ...any) { l.log("error", l.text.Errorf, format, args...) }
+
+// stopf reports why the run stopped early. It is an error, but the message
+// already says so ("Interrupted: ...") and is written without "Error: ".
+func (l *logger) stopf(format string, args ...any) { l.log("error", l.text.Infof, format, args...) }
+
+// log passes the message to text, or writes its JSON record at level.
+func (l *logger) log(level string, text func(string, ...any), format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.json {
+		text(format, args...)
+		return
+	}
+	data, _ := json.Marshal(logRecord{Time: time.Now().Format(time.RFC3339Nano), Level: level, Msg: fmt.Sprintf(format, args...)})
+	l.out.Write(append(data, '\n'))
 }
 
+// exitProcessingFailed is the exit status when at least one input file could
+// not be processed (the output then only covers the files that succeeded).
+const exitProcessingFailed = 2
+
+// exitInterrupted is the exit status when the run is stopped with Ctrl+C; the
+// files written up to that point are removed.
+const exitInterrupted = 130
+
 func main() {
-	var parentFolder string
-	flag.StringVar(&parentFolder, "parentFolder", "", "Path to the directory containing log files.")
-	flag.StringVar(&parentFolder, "p", "", "(Short) Path to the directory containing log files.")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "process", "merge", "order", "format", "validate", "diff":
+			runStep(os.Args[1], os.Args[2:])
+			return
+		}
+	}
+
+	opts := logmerge.DefaultOptions("")
+	var parentFolders, include, exclude, extensions, redact stringList
+	flag.Var(&parentFolders, "parentFolder", "Path to the directory containing log files (repeatable, or comma-separated).")
+	flag.Var(&parentFolders, "p", "(Short) Path to the directory containing log files.")
+	filesFrom := flag.String("files-from", "", "Text file listing the input files, one path per line, used instead of searching --parentFolder.")
+	flag.StringVar(&opts.OutputDir, "output-dir", "", "Folder to create ProcessedLogs in (default: the first --parentFolder).")
+	flag.StringVar(&opts.WorkDir, "work-dir", "", "Folder to use as ProcessedLogs itself; nothing is written under --parentFolder.")
+	flag.StringVar(&opts.DateLayout, "dateLayout", "", "Go time layout used to parse timestamps (requires --datePattern).")
+	flag.StringVar(&opts.DatePattern, "datePattern", "", "Regex matching the timestamp in each line (requires --dateLayout).")
+	delimiterFlag := flag.String("delimiter", lineContinuationDelimiter, "Delimiter used to join continuation lines; Go escapes such as \\x00 are allowed.")
+	flag.StringVar(&opts.Prefix, "prefix", "", "Prepended to the name of every file written to ProcessedLogs, e.g. incident123- for incident123-MERGED.log.")
+	flag.StringVar(&opts.Output, "output", "", "Path of the final formatted file (default: <parentFolder>/ProcessedLogs/FINAL_FORMATTED.log).")
+	flag.BoolVar(&opts.Gzip, "gzip", false, "Write the final file gzip-compressed (adds a .gz extension).")
+	flag.IntVar(&opts.GzipLevel, "gzip-level", opts.GzipLevel, "Compression level for --gzip, from -2 (Huffman only) to 9 (best compression).")
+	flag.StringVar(&opts.Bucket, "bucket", "", "Split the final file by entry time: hour or day (FINAL_FORMATTED-2023-06-01-12.log, ...).")
+	fromFlag := flag.String("from", "", "Drop entries with a timestamp before this value (same format as the logs).")
+	toFlag := flag.String("to", "", "Drop entries with a timestamp after this value (same format as the logs).")
+	sinceFlag := flag.String("since", "", "Drop entries older than this Go duration before now, e.g. 2h or 30m; --from wins.")
+	flag.BoolVar(&opts.KeepUnparsed, "keep-unparsed", opts.KeepUnparsed, "With --from/--to, keep lines that have no timestamp alongside the entry before them.")
+	flag.BoolVar(&opts.AnnotateSource, "annotate-source", false, "Tag each entry with its source file name, e.g. \"[app-node2.log]\".")
+	redactEmails := flag.Bool("redact-emails", false, "Replace e-mail addresses in the logs with [REDACTED].")
+	flag.Var(&redact, "redact", "Replace text matching this regex with [REDACTED], e.g. \"token=\\S+\" (repeatable).")
+	flag.IntVar(&opts.DetectLines, "detect-lines", opts.DetectLines, "Number of non-blank lines scanned to detect the timestamp format.")
+	flag.BoolVar(&opts.FallbackModTime, "fallback-modtime", false, "Order a file without usable timestamps by its modification time instead of skipping it.")
+	flag.BoolVar(&opts.Anchor, "anchor", false, "Only accept a timestamp at the very start of a line, not one quoted in a message.")
+	formatsFlag := flag.String("formats", "", "Comma-separated timestamp formats to detect, in priority order: comma-ms, dot-ms, iso8601, syslog (default: all).")
+	flag.BoolVar(&opts.MixedFormats, "mixed-formats", false, "Let a timestamp in any of the --formats start an entry anywhere in a file, not just the detected one.")
+	flag.IntVar(&opts.AssumeYear, "assume-year", 0, "Year of the last year-less timestamp (e.g. \"Jun 01 12:34:56\") in each file; default: the current year.")
+	flag.BoolVar(&opts.JSONInput, "json-input", false, "Read inputs as JSON lines ordered by the --ts-field timestamp.")
+	flag.StringVar(&opts.TSField, "ts-field", opts.TSField, "With --json-input, the field holding each entry's timestamp; a.b names a nested field.")
+	flag.StringVar(&opts.ContinuationRule, "continuation-rule", opts.ContinuationRule, "Which lines continue an entry: timestamp (lines without one) or indent (indented lines).")
+	flag.StringVar(&opts.Encoding, "encoding", opts.Encoding, "Input encoding: auto (detect a UTF-8/UTF-16 byte order mark), utf8, utf16le or utf16be.")
+	flag.StringVar(&opts.EncodingOut, "encoding-out", opts.EncodingOut, "Output encoding: utf8 (no byte order mark), utf16le or utf16be.")
+	maxLineFlag := flag.String("max-line-bytes", "0", "Cut input lines longer than this, e.g. 1MB, so one runaway line cannot exhaust memory; 0 disables.")
+	flag.StringVar(&opts.LongLines, "long-lines", opts.LongLines, "What to do with lines over --max-line-bytes: truncate or drop.")
+	tzFlag := flag.String("tz", "", "Rewrite timestamps in the output to this time zone, e.g. UTC or Europe/Amsterdam.")
+	flag.BoolVar(&opts.NormalizeTimestamps, "normalize-timestamps", false, "Rewrite timestamps in the output in RFC 3339.")
+	flag.StringVar(&opts.TSPrecision, "ts-precision", "ns", "Truncate normalized, JSON and --bucket timestamps to ns, us, ms or s.")
+	maxMemoryFlag := flag.String("max-memory", "1GB", "Merged size above which ordering spills sorted chunks to disk, e.g. 512MB; 0 disables.")
+	flag.StringVar(&opts.TmpDir, "tmp-dir", "", "Folder for the on-disk sort's chunks (default: ProcessedLogs/sort-tmp).")
+	flag.IntVar(&opts.Tail, "tail", 0, "Keep only the N most recent entries; a multi-line entry counts once.")
+	flag.BoolVar(&opts.Reverse, "reverse", false, "Order entries newest first.")
+	flag.BoolVar(&opts.NoSort, "no-sort", false, "Skip ordering; keep the merged file-then-line order.")
+	flag.StringVar(&opts.Level, "level", "", "Keep only entries at or above this level: TRACE, DEBUG, INFO, WARN, ERROR or FATAL.")
+	flag.StringVar(&opts.LevelRegex, "level-regex", opts.LevelRegex, "Regex locating the level token in an entry's first line; group 1 is used if present.")
+	flag.BoolVar(&opts.Recursive, "recursive", opts.Recursive, "Also search the subfolders of --parentFolder; --recursive=false reads only the folder itself.")
+	flag.IntVar(&opts.MaxDepth, "max-depth", 0, "Subfolder levels searched below --parentFolder (1 = direct subfolders only); 0 is unlimited.")
+	flag.Var(&include, "include", "Only process files whose name matches this glob, e.g. \"app-*.log\" (repeatable).")
+	flag.Var(&exclude, "exclude", "Skip files whose name matches this glob, e.g. \"debug-*.log\" (repeatable).")
+	flag.BoolVar(&opts.Rotated, "rotated", false, "Merge numbered rotations (app.log.2, app.log.1, app.log) oldest first as one stream.")
+	flag.Var(&extensions, "ext", "Input file extension, e.g. out for app.out and app.out.1 (repeatable; default log).")
+	flag.BoolVar(&opts.Dedup, "dedup", false, "Drop entries identical to the entry right before them after sorting.")
+	flag.BoolVar(&opts.DedupIgnoreSource, "dedup-ignore-source", false, "With --dedup, ignore the --annotate-source tag when comparing entries.")
+	flag.BoolVar(&opts.DedupGlobal, "dedup-global", false, "Drop every repeat of an entry anywhere in the output; keeps a hash per distinct entry in memory.")
+	flag.BoolVar(&opts.Collapse, "collapse", false, "Write runs of identical consecutive entries once, with a \"(repeated N times)\" suffix.")
+	flag.BoolVar(&opts.CollapseIgnoreTimestamp, "collapse-ignore-timestamp", false, "With --collapse, compare entries without their timestamp.")
+	flag.StringVar(&opts.EOL, "eol", opts.EOL, "Line ending of the final file: auto (match the inputs), lf or crlf.")
+	flag.StringVar(&opts.Format, "format", opts.Format, "Final output format: text or json (one JSON object per entry).")
+	flag.BoolVar(&opts.Color, "color", false, "Highlight ERROR, WARN and INFO levels when the output is a terminal.")
+	flag.BoolVar(&opts.KeepIntermediate, "keep-intermediate", false, "Keep all intermediate files in ProcessedLogs instead of deleting them.")
+	flag.BoolVar(&opts.Incremental, "incremental", false, "Keep processed files and a cache, and reuse them for inputs unchanged since the last run.")
+	flag.BoolVar(&opts.Force, "force", false, "With --incremental, process every input again instead of using the cache.")
+	keepFlag := flag.String("keep", "", "Comma-separated intermediates to keep: merged, ordered, processed.")
+	quiet := flag.Bool("quiet", false, "Do not print progress while processing files.")
+	logFormat := flag.String("log-format", "text", "Format of the messages on stderr: text or json.")
+	forceProgress := flag.Bool("progress", false, "Print progress even when stderr is not a terminal.")
+	flag.BoolVar(&opts.Verbose, "verbose", false, "Print a message after each pipeline step.")
+	flag.BoolVar(&opts.Strict, "strict", false, "Abort the whole run if any file cannot be processed.")
+	flag.BoolVar(&opts.SkipEmpty, "skip-empty", false, "Skip empty or whitespace-only files instead of reporting them as unprocessable.")
+	flag.BoolVar(&opts.StrictTimestamps, "strict-timestamps", false, "Abort the run if a timestamp matches the date pattern but cannot be parsed.")
+	flag.DurationVar(&opts.SkewThreshold, "skew-threshold", 0, "Warn about inputs whose time ranges overlap by more than this, e.g. 5m (possible clock skew).")
+	flag.StringVar(&opts.OnCollision, "on-collision", opts.OnCollision, "What to do with inputs in different folders sharing a file name: rename, skip or error.")
+	flag.IntVar(&opts.Preview, "preview", 0, "Process and order everything, then print the first N entries to stdout instead of writing the final file.")
+	countOnly := flag.Bool("count-only", false, "Print how many entries each file holds after multi-line grouping, without merging.")
+	watch := flag.Bool("watch", false, "After the run, run again whenever an input is added, removed or written to.")
+	watchInterval := flag.Duration("watch-interval", 2*time.Second, "With --watch, how often to check the inputs.")
+	dryRun := flag.Bool("dry-run", false, "List the files that would be processed and their detected format; only manifest.json is written.")
+	useStdin := flag.Bool("stdin", false, "Read a single log stream from stdin and write the result to stdout (same as --parentFolder -).")
+	flag.IntVar(&opts.Workers, "workers", opts.Workers, "Number of log files processed concurrently.")
+	flag.IntVar(&opts.MaxOpenFiles, "max-open-files", 0, "Most files open at once across all steps, at least 8; 0 derives it from the OS limit.")
+	flag.IntVar(&opts.OpenRetries, "open-retries", opts.OpenRetries, "How many times to retry opening an input after a transient error such as EAGAIN or a timeout.")
+	slowFiles := flag.Int("slow-files", 5, "With --verbose, list this many of the slowest files to process; 0 lists none.")
+	statsJSON := flag.String("stats-json", "", "Write run metrics as a JSON object to this path, or - for stdout.")
+	flag.StringVar(&opts.SortFiles, "sort-files", "", "Order the files found by name, modtime (newest first) or size (largest first).")
+	flag.IntVar(&opts.LimitFiles, "limit-files", 0, "Use only the first N files found, after --sort-files; 0 uses all.")
+	flag.StringVar(&opts.PerFileOutput, "per-file-output", "", "Also copy each processed file (entries joined into single lines) to this folder.")
+	flag.BoolVar(&opts.NoMerge, "no-merge", false, "With --per-file-output, stop after processing: no merge, order or format.")
+	flag.StringVar(&opts.SplitBy, "split-by-regex", "", "Regex whose first capture group names the stream of each entry; inputs are split by stream before merging.")
+	flag.BoolVar(&opts.SplitOutputs, "split-outputs", false, "With --split-by-regex, write one final file per stream.")
+	flag.BoolVar(&opts.PreserveUnparsedPosition, "preserve-unparsed-position", false, "Keep entries without a timestamp of their own where they are and sort the others around them.")
+	flag.StringVar(&opts.TiebreakRegex, "tiebreak-regex", "", "Regex whose first capture group orders entries with equal timestamps.")
+	flag.BoolVar(&opts.ShowAllWarnings, "show-all-warnings", false, "Warn about every line without a parseable timestamp, not just the first 10.")
+	configPath := flag.String("config", "", "JSON file with default flag values; command-line flags take precedence.")
 	showHelp := flag.Bool("h", false, "Display help.")
+	showVersion := flag.Bool("version", false, "Print version information and exit.")
+	flag.BoolVar(showVersion, "v", false, "Alias for --version.")
 	flag.Parse()
 
 	if *showHelp {
 		displayHelp()
 		return
 	}
-	if parentFolder == "" {
-		fmt.Println("Error: --parentFolder is required.")
+	if *showVersion {
+		printVersion()
+		return
+	}
+	fromEnv, err := applyEnv(flag.CommandLine)
+	if err != nil {
+		infoOut.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if *configPath != "" {
+		if err := loadConfig(*configPath, fromEnv); err != nil {
+			infoOut.Errorf("%v", err)
+			os.Exit(1)
+		}
+	}
+	if err := infoOut.setFormat(*logFormat); err != nil {
+		infoOut.Errorf("%v", err)
+		os.Exit(1)
+	}
+	for _, value := range parentFolders {
+		for _, folder := range strings.Split(value, ",") {
+			if folder = strings.TrimSpace(folder); folder != "" {
+				opts.ExtraFolders = append(opts.ExtraFolders, folder)
+			}
+		}
+	}
+	if len(opts.ExtraFolders) > 0 {
+		opts.ParentFolder, opts.ExtraFolders = opts.ExtraFolders[0], opts.ExtraFolders[1:]
+	}
+	if opts.ParentFolder == "-" {
+		*useStdin = true
+	}
+	if *filesFrom != "" {
+		files, err := readFileList(*filesFrom)
+		if err != nil {
+			infoOut.Errorf("%v", err)
+			os.Exit(1)
+		}
+		opts.Files = files
+		if opts.ParentFolder == "" && opts.OutputDir == "" && opts.WorkDir == "" {
+			opts.OutputDir = filepath.Dir(*filesFrom)
+		}
+	}
+	if opts.ParentFolder == "" && opts.Files == nil && !*useStdin {
+		infoOut.Errorf("--parentFolder is required.")
 		flag.Usage()
 		os.Exit(1)
 	}
-
-	// Validate path
-	info, err := os.Stat(parentFolder)
-	if err != nil || !info.IsDir() {
-		fmt.Printf("Error: The provided path '%s' is not a valid directory.\n", parentFolder)
+	opts.Log = infoOut
+	opts.Include, opts.Exclude = include, exclude
+	if len(extensions) > 0 {
+		opts.Extensions = extensions
+	}
+	if opts.LineTransform, err = redactor(*redactEmails, redact); err != nil {
+		infoOut.Errorf("%v", err)
 		os.Exit(1)
 	}
+	if opts.Delimiter, err = parseDelimiter(*delimiterFlag); err != nil {
+		infoOut.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if *fromFlag != "" && *sinceFlag != "" {
+		infoOut.Warnf("both --from and --since are set; --since is ignored.")
+	}
+	if opts.From, opts.To, opts.Since, err = parseTimeWindow(*fromFlag, *toFlag, *sinceFlag, opts.DateLayout); err != nil {
+		infoOut.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if *tzFlag != "" {
+		if opts.Location, err = time.LoadLocation(*tzFlag); err != nil {
+			infoOut.Errorf("invalid --tz %q: %v", *tzFlag, err)
+			os.Exit(1)
+		}
+	}
+	if opts.MaxMemory, err = parseByteSize(*maxMemoryFlag); err != nil {
+		infoOut.Errorf("invalid --max-memory %q: %v", *maxMemoryFlag, err)
+		os.Exit(1)
+	}
+	if opts.MaxLineBytes, err = parseByteSize(*maxLineFlag); err != nil {
+		infoOut.Errorf("invalid --max-line-bytes %q: %v", *maxLineFlag, err)
+		os.Exit(1)
+	}
+	opts.Keep = commaList(*keepFlag)
+	opts.Formats = commaList(*formatsFlag)
+	if !*quiet && (*forceProgress || isTerminal(os.Stderr)) {
+		opts.Progress = os.Stderr
+	}
 
-	// Create or verify ProcessedLogs folder
-	processFolder := createProcessedLogsFolder(parentFolder)
+	if *watch && (*useStdin || *dryRun || *countOnly) {
+		infoOut.Errorf("--watch cannot be combined with --stdin, --dry-run or --count-only.")
+		os.Exit(1)
+	}
+	if *watch && *watchInterval <= 0 {
+		infoOut.Errorf("--watch-interval must be positive.")
+		os.Exit(1)
+	}
 
-	// Gather .log files
-	allLogs := getAllLogFiles(parentFolder)
-	if len(allLogs) == 0 {
-		fmt.Println("No .log files found in the specified directory or its subdirectories.")
+	if *useStdin {
+		opts.Color = opts.Color && isTerminal(os.Stdout)
+		out := bufio.NewWriter(os.Stdout)
+		err := logmerge.ProcessStream(os.Stdin, out, opts)
+		if err == nil {
+			err = out.Flush()
+		}
+		if err != nil {
+			infoOut.Errorf("%v", err)
+			os.Exit(1)
+		}
 		return
 	}
 
-	// Process logs in parallel
-	processedLogFiles := processLogs(allLogs, processFolder)
-
-	// Merge processed logs
-	mergedFilePath := filepath.Join(processFolder, "MERGED.log")
-	mergeProcessedLogs(processedLogFiles, mergedFilePath)
-
-	// Determine date pattern from merged log
-	dateTimePattern := determineDateTimePattern(mergedFilePath)
-	if dateTimePattern == "" {
-		fmt.Println("Warning: Could not detect date pattern. The ordering step may fail.")
+	if opts.Preview > 0 {
+		opts.PreviewOut = os.Stdout
+		opts.Color = opts.Color && isTerminal(os.Stdout)
 	}
 
-	// Order logs by date/time
-	orderedFilePath := filepath.Join(processFolder, "MERGED_ORDERED.log")
-	orderByDate(mergedFilePath, orderedFilePath, dateTimePattern)
-
-	// Format logs (split lines by the lineContinuationDelimiter)
-	finalFormattedFilePath := filepath.Join(processFolder, "FINAL_FORMATTED.log")
-	formatSupport(orderedFilePath, finalFormattedFilePath, dateTimePattern)
-
-	// Clean up
-	cleanupProcessFolder(processFolder, finalFormattedFilePath)
+	if *dryRun {
+		if dryRunReport(opts) == 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if *countOnly {
+		if status := countReport(opts); status != 0 {
+			os.Exit(status)
+		}
+		return
+	}
 
-	fmt.Println("All processing complete.")
-	fmt.Printf("Final file saved at: %s\n", finalFormattedFilePath)
+	// The first Ctrl+C stops the run cleanly, a second one kills it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	run := func() int { return runPipeline(ctx, opts, *statsJSON, *slowFiles) }
+	if *watch {
+		watchInputs(ctx, opts, *watchInterval, run)
+		return
+	}
+	if status := run(); status != 0 {
+		os.Exit(status)
+	}
 }
 
-func displayHelp() {
-	fmt.Println("LogProcessor - A CLI tool to merge and order log files. Version:", getVersion())
-	fmt.Println()
-	fmt.Println("Usage:")
-	fmt.Println("  go run main.go --parentFolder \"C:\\path\\to\\log\\directory\"")
-	fmt.Println("Options:")
-	fmt.Println("  --parentFolder, -p    The path to the directory containing log files to be processed.")
-	fmt.Println("  --help, -h            Display this help message.")
-	fmt.Println()
-}
+// runPipeline runs the whole pipeline once and reports the result. It returns
+// the exit status: 0, 1 when the run failed, or exitProcessingFailed.
+func runPipeline(ctx context.Context, opts logmerge.Options, statsJSON string, slowFiles int) int {
+	result, err := logmerge.ProcessContext(ctx, opts)
+	switch {
+	case errors.Is(err, context.Canceled):
+		infoOut.stopf("Interrupted: partial output was removed.")
+		os.Exit(exitInterrupted)
+	case errors.Is(err, logmerge.ErrNoLogFiles):
+		infoOut.Infof("No .log files found in the specified directory or its subdirectories.")
+		return 0
+	case errors.Is(err, logmerge.ErrAborted):
+		infoOut.stopf("Aborting: a file could not be processed and --strict is set.")
+		return exitProcessingFailed
+	case err != nil:
+		infoOut.Errorf("%v", err)
+		return 1
+	}
 
-func createProcessedLogsFolder(parentFolder string) string {
-	processedLogsPath := filepath.Join(parentFolder, "ProcessedLogs")
-	if _, err := os.Stat(processedLogsPath); os.IsNotExist(err) {
-		if err := os.Mkdir(processedLogsPath, os.ModePerm); err != nil {
-			fmt.Printf("Error creating ProcessedLogs folder: %v\n", err)
-			os.Exit(1)
+	if opts.Verbose {
+		printStats(result.Stats, !opts.NoSort)
+		printSlowFiles(result.Files, slowFiles)
+	}
+	if statsJSON != "" {
+		if err := writeStatsJSON(statsJSON, result); err != nil {
+			infoOut.Errorf("%v", err)
 		}
-		fmt.Println("ProcessedLogs folder created successfully.")
-	} else {
-		fmt.Println("ProcessedLogs folder already exists.")
 	}
-	return processedLogsPath
+	if result.ParseErrors > 0 {
+		infoOut.Warnf("%d line(s) have a timestamp that could not be parsed; see %s.", result.ParseErrors, result.ParseErrorReport)
+	}
+	if result.LongLines > 0 {
+		action := "truncated"
+		if opts.LongLines == "drop" || opts.JSONInput {
+			action = "dropped"
+		}
+		infoOut.Warnf("%d line(s) longer than --max-line-bytes were %s.", result.LongLines, action)
+	}
+	if len(result.Skipped) > 0 {
+		infoOut.Infof("Skipped %d file(s): %s; see %s.", len(result.Skipped), skipSummary(result.Skipped), result.SkippedReport)
+	}
+	if result.Failed > 0 {
+		infoOut.Infof("Processing complete, but %d of %d file(s) could not be processed.", result.Failed, len(result.Files))
+		printFinalFiles(result)
+		return exitProcessingFailed
+	}
+	infoOut.Infof("All processing complete.")
+	printFinalFiles(result)
+	return 0
 }
 
-func getAllLogFiles(folderPath string) []string {
-	var logFiles []string
-	err := filepath.Walk(folderPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			match, _ := regexp.MatchString(`\.log(\.\d+)?$`, info.Name())
-			if match {
-				logFiles = append(logFiles, path)
-			}
+// skipSummary counts skipped by reason, e.g. "3 excluded, 1 empty", most
+// frequent first.
+func skipSummary(skipped []logmerge.SkippedFile) string {
+	counts := skipCounts(skipped)
+	reasons := make([]string, 0, len(counts))
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		if counts[reasons[i]] != counts[reasons[j]] {
+			return counts[reasons[i]] > counts[reasons[j]]
 		}
-		return nil
+		return reasons[i] < reasons[j]
 	})
-	if err != nil {
-		fmt.Printf("Error searching for log files: %v\n", err)
+	parts := make([]string, len(reasons))
+	for i, reason := range reasons {
+		parts[i] = fmt.Sprintf("%d %s", counts[reason], reason)
 	}
-	return logFiles
+	return strings.Join(parts, ", ")
 }
 
-func processLogs(logFiles []string, processFolder string) []string {
-	jobs := make(chan string, len(logFiles))
-	results := make(chan string, len(logFiles))
-	errs := make(chan error, len(logFiles))
-
-	var wg sync.WaitGroup
-
-	// Spawn workerCount workers
-	for w := 0; w < workerCount; w++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for logFile := range jobs {
-				baseFileName := filepath.Base(logFile)
-				processedLogFile := filepath.Join(processFolder, baseFileName)
-				processedLogFile = getUniqueFileName(processedLogFile)
-
-				if err := processLogFile(logFile, processedLogFile); err != nil {
-					errs <- fmt.Errorf("%s was not processed: %v", logFile, err)
-				} else {
-					results <- processedLogFile
-				}
-			}
-		}()
+// skipCounts counts skipped by reason.
+func skipCounts(skipped []logmerge.SkippedFile) map[string]int {
+	counts := make(map[string]int)
+	for _, s := range skipped {
+		counts[s.Reason]++
 	}
+	return counts
+}
 
-	// Enqueue jobs
-	for _, logFile := range logFiles {
-		jobs <- logFile
+// watchInputs calls run, then again each time the inputs of opts change,
+// until ctx is done. The inputs are checked every interval, so bursts of
+// writes cause at most one run per interval.
+func watchInputs(ctx context.Context, opts logmerge.Options, interval time.Duration, run func() int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := inputState(opts)
+	run()
+	infoOut.Infof("Watching for changes every %v; press Ctrl+C to stop.", interval)
+	for {
+		select {
+		case <-ctx.Done():
+			infoOut.Infof("Stopped watching.")
+			return
+		case <-ticker.C:
+		}
+		if state := inputState(opts); state != last {
+			infoOut.Infof("Inputs changed; running again.")
+			last = state
+			run()
+		}
 	}
-	close(jobs)
-
-	// Wait for workers to finish
-	wg.Wait()
-	close(results)
-	close(errs)
+}
 
-	// Collect results
-	var processedLogFiles []string
-	for r := range results {
-		processedLogFiles = append(processedLogFiles, r)
+// inputState describes the inputs of opts: their paths, sizes and
+// modification times. It differs as soon as a file is added, removed or
+// written to.
+func inputState(opts logmerge.Options) string {
+	files, err := logmerge.Inputs(opts)
+	if err != nil {
+		return "error: " + err.Error()
 	}
-	for e := range errs {
-		fmt.Println(e)
+	var state strings.Builder
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			fmt.Fprintf(&state, "%s\t%d\t%d\n", file, info.Size(), info.ModTime().UnixNano())
+		} else {
+			fmt.Fprintf(&state, "%s\t%v\n", file, err)
+		}
 	}
-
-	return processedLogFiles
+	return state.String()
 }
 
-func getUniqueFileName(filePath string) string {
-	directory := filepath.Dir(filePath)
-	fileNameWithoutExtension := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
-	extension := filepath.Ext(filePath)
-
-	count := 1
-	newFilePath := filePath
+// commaList splits a comma-separated flag value into lower-case names,
+// dropping empty ones.
+func commaList(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(strings.ToLower(name)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
 
-	for {
-		_, err := os.Stat(newFilePath)
-		if os.IsNotExist(err) {
-			break
+// readFileList reads the --files-from list: one path per line, in merge order.
+// Blank lines and lines starting with # are skipped.
+func readFileList(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading --files-from %s: %v", path, err)
+	}
+	var files []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			files = append(files, line)
 		}
-		newFilePath = filepath.Join(directory, fmt.Sprintf("%s%d%s", fileNameWithoutExtension, count, extension))
-		count++
 	}
-	return newFilePath
+	if len(files) == 0 {
+		return nil, fmt.Errorf("--files-from %s lists no files", path)
+	}
+	return files, nil
 }
 
-func processLogFile(inputFilePath, outputFilePath string) error {
-	dateTimePattern := determineDateTimePattern(inputFilePath)
-	if dateTimePattern == "" {
-		return fmt.Errorf("skipping file %s due to unrecognized date pattern", inputFilePath)
+// printFinalFiles tells where the final file, or the --bucket files, and the
+// --per-file-output copies went.
+func printFinalFiles(result logmerge.Result) {
+	if len(result.PerFile) > 0 {
+		infoOut.Infof("Per-file outputs saved in %s (%d file(s)).", filepath.Dir(result.PerFile[0]), len(result.PerFile))
+	}
+	if result.Output == "" {
+		return
 	}
+	if len(result.Buckets) == 0 {
+		infoOut.Infof("Final file saved at: %s", result.Output)
+		return
+	}
+	var list strings.Builder
+	for _, path := range result.Buckets {
+		fmt.Fprintf(&list, "\n  %s", filepath.Base(path))
+	}
+	infoOut.Infof("Final files saved in %s:%s", filepath.Dir(result.Output), list.String())
+}
 
-	compiledRegex, err := regexp.Compile(dateTimePattern)
-	if err != nil {
-		return fmt.Errorf("failed to compile regex pattern: %v", err)
+// runStep runs the single pipeline step named by the first argument, e.g.
+// "order --in MERGED.log --out OUT.log", with only the flags that step uses.
+func runStep(name string, args []string) {
+	opts := logmerge.DefaultOptions("")
+	opts.Log = infoOut
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	in := fs.String("in", "", "Input file.")
+	out := fs.String("out", "", "Output file.")
+	delimiterFlag := fs.String("delimiter", lineContinuationDelimiter, "Delimiter used to join continuation lines; Go escapes such as \\x00 are allowed.")
+	fs.StringVar(&opts.DateLayout, "dateLayout", "", "Go time layout used to parse timestamps (requires --datePattern).")
+	fs.StringVar(&opts.DatePattern, "datePattern", "", "Regex matching the timestamp in each line (requires --dateLayout).")
+	fs.BoolVar(&opts.FallbackModTime, "fallback-modtime", false, "Order a file without usable timestamps by its modification time.")
+	fs.BoolVar(&opts.Anchor, "anchor", false, "Only accept a timestamp at the very start of a line.")
+	formatsFlag := fs.String("formats", "", "Comma-separated timestamp formats to detect, in priority order (default: all).")
+	logFormat := fs.String("log-format", "text", "Format of the messages on stderr: text or json.")
+	fs.IntVar(&opts.MaxOpenFiles, "max-open-files", 0, "Most files open at once, at least 8; 0 derives it from the OS limit.")
+	fs.IntVar(&opts.OpenRetries, "open-retries", opts.OpenRetries, "How many times to retry opening an input after a transient error.")
+	fromFlag, toFlag, sinceFlag, tzFlag, maxMemoryFlag, maxLineFlag := new(string), new(string), new(string), new(string), new(string), new(string)
+	redactEmails, redact := new(bool), new(stringList)
+	a, b := new(string), new(string)
+	*maxMemoryFlag, *maxLineFlag = "1GB", "0"
+	switch name {
+	case "process":
+		fs.IntVar(&opts.DetectLines, "detect-lines", opts.DetectLines, "Number of non-blank lines scanned to detect the timestamp format.")
+		fs.BoolVar(&opts.MixedFormats, "mixed-formats", false, "Let a timestamp in any of the --formats start an entry, not just the detected one.")
+		fs.IntVar(&opts.AssumeYear, "assume-year", 0, "Year of the last year-less timestamp in the file; default: the current year.")
+		fs.BoolVar(&opts.JSONInput, "json-input", false, "Read the input as JSON lines ordered by the --ts-field timestamp.")
+		fs.StringVar(&opts.TSField, "ts-field", opts.TSField, "With --json-input, the field holding each entry's timestamp.")
+		fs.StringVar(&opts.ContinuationRule, "continuation-rule", opts.ContinuationRule, "Which lines continue an entry: timestamp (lines without one) or indent (indented lines).")
+		fs.StringVar(&opts.Encoding, "encoding", opts.Encoding, "Input encoding: auto, utf8, utf16le or utf16be.")
+		fs.StringVar(maxLineFlag, "max-line-bytes", *maxLineFlag, "Cut input lines longer than this, e.g. 1MB; 0 disables.")
+		fs.StringVar(&opts.LongLines, "long-lines", opts.LongLines, "What to do with lines over --max-line-bytes: truncate or drop.")
+		fs.BoolVar(&opts.AnnotateSource, "annotate-source", false, "Tag each entry with its source file name.")
+		fs.BoolVar(&opts.StrictTimestamps, "strict-timestamps", false, "Fail if a timestamp matches the date pattern but cannot be parsed.")
+		fs.BoolVar(redactEmails, "redact-emails", false, "Replace e-mail addresses with [REDACTED].")
+		fs.Var(redact, "redact", "Replace text matching this regex with [REDACTED] (repeatable).")
+	case "order":
+		fs.StringVar(fromFlag, "from", "", "Drop entries with a timestamp before this value.")
+		fs.StringVar(toFlag, "to", "", "Drop entries with a timestamp after this value.")
+		fs.IntVar(&opts.AssumeYear, "assume-year", 0, "Year given to a year-less --from/--to; default: the current year.")
+		fs.StringVar(sinceFlag, "since", "", "Drop entries older than this duration before now, e.g. 2h; --from wins.")
+		fs.BoolVar(&opts.KeepUnparsed, "keep-unparsed", opts.KeepUnparsed, "With --from/--to, keep lines that have no timestamp alongside the entry before them.")
+		fs.StringVar(&opts.Level, "level", "", "Keep only entries at or above this level.")
+		fs.StringVar(&opts.LevelRegex, "level-regex", opts.LevelRegex, "Regex locating the level token in an entry's first line.")
+		fs.BoolVar(&opts.Dedup, "dedup", false, "Drop entries identical to the entry right before them.")
+		fs.BoolVar(&opts.DedupIgnoreSource, "dedup-ignore-source", false, "With --dedup, ignore the source tag when comparing entries.")
+		fs.BoolVar(&opts.DedupGlobal, "dedup-global", false, "Drop every repeat of an entry anywhere in the output.")
+		fs.IntVar(&opts.Tail, "tail", 0, "Keep only the N most recent entries.")
+		fs.BoolVar(&opts.Reverse, "reverse", false, "Order entries newest first.")
+		fs.BoolVar(&opts.ShowAllWarnings, "show-all-warnings", false, "Warn about every line without a parseable timestamp.")
+		fs.BoolVar(&opts.PreserveUnparsedPosition, "preserve-unparsed-position", false, "Keep entries without a timestamp where they are.")
+		fs.StringVar(&opts.TiebreakRegex, "tiebreak-regex", "", "Regex whose first capture group orders entries with equal timestamps.")
+		fs.StringVar(maxMemoryFlag, "max-memory", *maxMemoryFlag, "Input size above which sorted chunks are spilled to disk; 0 disables.")
+		fs.StringVar(&opts.TmpDir, "tmp-dir", "", "Folder for the spilled chunks (default: sort-tmp next to --out).")
+	case "format":
+		fs.StringVar(&opts.Format, "format", opts.Format, "Output format: text or json.")
+		fs.BoolVar(&opts.Color, "color", false, "Highlight levels when the output is a terminal.")
+		fs.BoolVar(&opts.AnnotateSource, "annotate-source", false, "With --format json, keep the source tag in the raw field.")
+		fs.BoolVar(&opts.Collapse, "collapse", false, "Write runs of identical consecutive entries once, with a repeat count.")
+		fs.BoolVar(&opts.CollapseIgnoreTimestamp, "collapse-ignore-timestamp", false, "With --collapse, compare entries without their timestamp.")
+		fs.StringVar(tzFlag, "tz", "", "Rewrite timestamps to this time zone.")
+		fs.BoolVar(&opts.NormalizeTimestamps, "normalize-timestamps", false, "Rewrite timestamps in RFC 3339.")
+		fs.StringVar(&opts.TSPrecision, "ts-precision", "ns", "Truncate normalized and JSON timestamps to ns, us, ms or s.")
+		fs.StringVar(&opts.EOL, "eol", "lf", "Line ending: lf or crlf.")
+		fs.StringVar(&opts.EncodingOut, "encoding-out", opts.EncodingOut, "Output encoding: utf8, utf16le or utf16be.")
+		fs.BoolVar(&opts.Gzip, "gzip", false, "Write the output gzip-compressed.")
+		fs.IntVar(&opts.GzipLevel, "gzip-level", opts.GzipLevel, "Compression level for --gzip, from -2 to 9.")
+		fs.StringVar(&opts.Bucket, "bucket", "", "Write one file per hour or day, named after --out.")
+		fs.StringVar(&opts.SplitBy, "split-by-regex", "", "Regex whose first capture group names the stream of each entry.")
+		fs.BoolVar(&opts.SplitOutputs, "split-outputs", false, "Write one file per --split-by-regex stream, named after --out.")
+	case "validate":
+		fs.StringVar(&opts.DatePattern, "pattern", "", "Same as --datePattern.")
+		fs.BoolVar(&opts.Reverse, "reverse", false, "Expect entries newest first.")
+		fs.StringVar(&opts.Encoding, "encoding", opts.Encoding, "Input encoding: auto, utf8, utf16le or utf16be.")
+	case "diff":
+		fs.StringVar(a, "a", "", "The old file.")
+		fs.StringVar(b, "b", "", "The new file.")
+		fs.StringVar(&opts.DatePattern, "pattern", "", "Same as --datePattern.")
+		fs.StringVar(&opts.Encoding, "encoding", opts.Encoding, "Input encoding: auto, utf8, utf16le or utf16be.")
+		fs.StringVar(&opts.Format, "format", opts.Format, "Report format: text or json (one object per entry).")
 	}
+	fs.Parse(args)
 
-	inFile, err := os.Open(inputFilePath)
-	if err != nil {
-		return fmt.Errorf("error opening file %s: %v", inputFilePath, err)
+	fail := func(err error) {
+		infoOut.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if _, err := applyEnv(fs); err != nil {
+		fail(err)
+	}
+	if err := infoOut.setFormat(*logFormat); err != nil {
+		fail(err)
+	}
+	if name == "diff" && (*a == "" || *b == "") {
+		fail(errors.New("usage: diff --a OLD.log --b NEW.log"))
+	}
+	if (*out == "" && name != "validate" && name != "diff") || (*in == "" && name != "merge" && name != "diff") || (name == "merge" && fs.NArg() == 0) {
+		switch name {
+		case "merge":
+			fail(errors.New("usage: merge --out MERGED.log FILE..."))
+		case "validate":
+			fail(errors.New("usage: validate --in FILE"))
+		}
+		fail(fmt.Errorf("usage: %s --in FILE --out FILE", name))
+	}
+	var err error
+	if opts.Delimiter, err = parseDelimiter(*delimiterFlag); err != nil {
+		fail(err)
+	}
+	opts.Formats = commaList(*formatsFlag)
+	if opts.LineTransform, err = redactor(*redactEmails, *redact); err != nil {
+		fail(err)
+	}
+	if *fromFlag != "" && *sinceFlag != "" {
+		infoOut.Warnf("both --from and --since are set; --since is ignored.")
+	}
+	if opts.From, opts.To, opts.Since, err = parseTimeWindow(*fromFlag, *toFlag, *sinceFlag, opts.DateLayout); err != nil {
+		fail(err)
+	}
+	if *tzFlag != "" {
+		if opts.Location, err = time.LoadLocation(*tzFlag); err != nil {
+			fail(fmt.Errorf("invalid --tz %q: %v", *tzFlag, err))
+		}
+	}
+	if opts.MaxMemory, err = parseByteSize(*maxMemoryFlag); err != nil {
+		fail(fmt.Errorf("invalid --max-memory %q: %v", *maxMemoryFlag, err))
+	}
+	if opts.MaxLineBytes, err = parseByteSize(*maxLineFlag); err != nil {
+		fail(fmt.Errorf("invalid --max-line-bytes %q: %v", *maxLineFlag, err))
 	}
-	defer inFile.Close()
 
-	outFile, err := os.Create(outputFilePath)
+	switch name {
+	case "process":
+		err = logmerge.ProcessFile(*in, *out, opts)
+	case "merge":
+		err = logmerge.Merge(fs.Args(), *out, opts)
+	case "order":
+		err = logmerge.Order(*in, *out, opts)
+	case "format":
+		err = logmerge.Format(*in, *out, opts)
+	case "validate":
+		var entries int
+		if entries, err = logmerge.Validate(*in, opts); err == nil {
+			fmt.Fprintf(os.Stdout, "%s is in timestamp order (%d timestamps checked).\n", *in, entries)
+		}
+	case "diff":
+		var result logmerge.DiffResult
+		if result, err = logmerge.Diff(*a, *b, opts); err == nil {
+			err = printDiff(result, *a, *b, opts.Format == "json")
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("error creating output file %s: %v", outputFilePath, err)
+		fail(err)
 	}
-	defer outFile.Close()
-
-	reader := bufio.NewReader(inFile)
-	var currentLogEntry string
-	lineNumber := 0
+}
 
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
-			return fmt.Errorf("error reading line %d: %v", lineNumber, err)
-		}
-		lineNumber++
-		line = strings.TrimRight(line, "\r\n")
+// diffLine is one entry of the diff step's --format json report.
+type diffLine struct {
+	File      string `json:"file"` // "a" or "b", the file that has the entry
+	Line      int    `json:"line"`
+	Timestamp string `json:"timestamp,omitempty"` // RFC 3339; omitted when unparseable
+	Text      string `json:"text"`
+}
 
-		if compiledRegex.MatchString(line) {
-			if currentLogEntry != "" {
-				if _, err := outFile.WriteString(currentLogEntry + "\n"); err != nil {
-					return fmt.Errorf("error writing to file %s: %v", outputFilePath, err)
+// printDiff writes the entries only one of the files a and b has to stdout:
+// under a heading per file, or as JSON lines with asJSON.
+func printDiff(result logmerge.DiffResult, a, b string, asJSON bool) error {
+	out := bufio.NewWriter(os.Stdout)
+	if asJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetEscapeHTML(false)
+		for _, side := range []struct {
+			file    string
+			entries []logmerge.DiffEntry
+		}{{"a", result.OnlyA}, {"b", result.OnlyB}} {
+			for _, entry := range side.entries {
+				line := diffLine{File: side.file, Line: entry.Line, Text: entry.Text}
+				if !entry.Timestamp.IsZero() {
+					line.Timestamp = entry.Timestamp.Format(time.RFC3339Nano)
+				}
+				if err := encoder.Encode(line); err != nil {
+					return err
 				}
 			}
-			currentLogEntry = line
-		} else if currentLogEntry != "" {
-			currentLogEntry += lineContinuationDelimiter + line
 		}
+		return out.Flush()
 	}
-
-	// Write the last collected entry if any
-	if currentLogEntry != "" {
-		if _, err := outFile.WriteString(currentLogEntry + "\n"); err != nil {
-			return fmt.Errorf("error writing to file %s: %v", outputFilePath, err)
+	for _, side := range []struct {
+		file    string
+		entries []logmerge.DiffEntry
+	}{{a, result.OnlyA}, {b, result.OnlyB}} {
+		if len(side.entries) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "Only in %s (%d):\n", side.file, len(side.entries))
+		for _, entry := range side.entries {
+			fmt.Fprintf(out, "%6d: %s\n", entry.Line, strings.ReplaceAll(entry.Text, "\n", "\n        "))
 		}
 	}
-
-	return nil
+	fmt.Fprintf(out, "%d entries only in %s, %d only in %s.\n", len(result.OnlyA), a, len(result.OnlyB), b)
+	return out.Flush()
 }
 
-func determineDateTimePattern(filePath string) string {
-	f, err := os.Open(filePath)
-	if err != nil {
-		fmt.Printf("Error opening file for date pattern detection: %v\n", err)
-		return ""
+// printStats prints the --verbose run summary.
+func printStats(s logmerge.Stats, sorted bool) {
+	summary := fmt.Sprintf("Summary: %d file(s), %d bytes in", s.InputFiles, s.InputBytes)
+	if sorted {
+		summary += fmt.Sprintf(", %d entries out", s.Entries)
+	}
+	if !s.Earliest.IsZero() {
+		summary += fmt.Sprintf(", %s to %s", s.Earliest.Format(time.RFC3339Nano), s.Latest.Format(time.RFC3339Nano))
 	}
-	defer f.Close()
+	infoOut.Infof("%s.", summary)
+	infoOut.Infof("Step times: process %v, merge %v, order %v, format %v.",
+		s.Process.Round(time.Millisecond), s.Merge.Round(time.Millisecond), s.Order.Round(time.Millisecond), s.Format.Round(time.Millisecond))
+}
 
-	scanner := bufio.NewScanner(f)
-	linesToCheck := 5
-	for i := 0; i < linesToCheck && scanner.Scan(); i++ {
-		line := scanner.Text()
-		if matched, _ := regexp.MatchString(defaultPattern, line); matched {
-			return defaultPattern
+// printSlowFiles prints the n inputs that took longest to process, with their
+// size on disk and the lines read.
+func printSlowFiles(files []logmerge.FileResult, n int) {
+	var timed []logmerge.FileResult
+	for _, file := range files {
+		if file.Duration > 0 {
+			timed = append(timed, file)
 		}
-		if matched, _ := regexp.MatchString(supportPattern, line); matched {
-			return supportPattern
+	}
+	if n <= 0 || len(timed) == 0 {
+		return
+	}
+	sort.SliceStable(timed, func(i, j int) bool { return timed[i].Duration > timed[j].Duration })
+	if len(timed) > n {
+		timed = timed[:n]
+	}
+	var list strings.Builder
+	for _, file := range timed {
+		var size int64
+		if info, err := os.Stat(file.Input); err == nil {
+			size = info.Size()
 		}
+		fmt.Fprintf(&list, "\n  %v\t%s\t%d bytes, %d lines", file.Duration.Round(time.Millisecond), file.Input, size, file.LinesRead)
 	}
-	return ""
+	infoOut.Infof("Slowest file(s):%s", list.String())
+}
+
+// statsReport is the --stats-json document. Fields are only ever added, so
+// consumers can rely on the existing ones across versions.
+type statsReport struct {
+	SchemaVersion int      `json:"schemaVersion"`
+	Output        string   `json:"output"`
+	Buckets       []string `json:"buckets,omitempty"` // the --bucket files
+	Files         int      `json:"files"`
+	FailedFiles   int      `json:"failedFiles"`
+	SkippedEmpty  int      `json:"skippedEmpty"`
+	ParseErrors   int      `json:"parseErrors"`
+	LongLines     int      `json:"longLines"`
+	Errors        int      `json:"errors"` // failedFiles + parseErrors
+	InputBytes    int64    `json:"inputBytes"`
+	Entries       int      `json:"entries"`
+	Earliest      string   `json:"earliest,omitempty"` // RFC 3339; omitted when unknown
+	Latest        string   `json:"latest,omitempty"`
+	ProcessMillis int64    `json:"processMillis"`
+	MergeMillis   int64    `json:"mergeMillis"`
+	OrderMillis   int64    `json:"orderMillis"`
+	FormatMillis  int64    `json:"formatMillis"`
+	// FileTimes lists every input in merge order; millis is 0 for inputs
+	// skipped or reused from the --incremental cache.
+	FileTimes []fileTime `json:"fileTimes"`
+	// Skipped counts the inputs left out by reason, as in skipped.json.
+	Skipped map[string]int `json:"skipped,omitempty"`
+}
+
+// fileTime is the processing time of one input in statsReport.
+type fileTime struct {
+	Path   string `json:"path"`
+	Millis int64  `json:"millis"`
+	Bytes  int64  `json:"bytes"` // decompressed bytes read
+	Lines  int    `json:"lines"`
 }
 
-func mergeProcessedLogs(logFiles []string, outputFilePath string) {
-	outFile, err := os.Create(outputFilePath)
+// writeStatsJSON writes the metrics of result to path ("-" for stdout).
+func writeStatsJSON(path string, result logmerge.Result) error {
+	s := result.Stats
+	report := statsReport{
+		SchemaVersion: 1,
+		Output:        result.Output,
+		Buckets:       result.Buckets,
+		Files:         s.InputFiles,
+		FailedFiles:   result.Failed,
+		SkippedEmpty:  result.SkippedEmpty,
+		Skipped:       skipCounts(result.Skipped),
+		ParseErrors:   result.ParseErrors,
+		LongLines:     result.LongLines,
+		Errors:        result.Failed + result.ParseErrors,
+		InputBytes:    s.InputBytes,
+		Entries:       s.Entries,
+		ProcessMillis: s.Process.Milliseconds(),
+		MergeMillis:   s.Merge.Milliseconds(),
+		OrderMillis:   s.Order.Milliseconds(),
+		FormatMillis:  s.Format.Milliseconds(),
+		FileTimes:     make([]fileTime, len(result.Files)),
+	}
+	for i, file := range result.Files {
+		report.FileTimes[i] = fileTime{Path: file.Input, Millis: file.Duration.Milliseconds(), Bytes: file.BytesRead, Lines: file.LinesRead}
+	}
+	if !s.Earliest.IsZero() {
+		report.Earliest, report.Latest = s.Earliest.Format(time.RFC3339Nano), s.Latest.Format(time.RFC3339Nano)
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
 	if err != nil {
-		fmt.Printf("Error creating merged file: %v\n", err)
-		return
+		return fmt.Errorf("error encoding --stats-json: %v", err)
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = os.WriteFile(path, data, 0644)
 	}
-	defer outFile.Close()
+	if err != nil {
+		return fmt.Errorf("error writing --stats-json: %v", err)
+	}
+	return nil
+}
 
-	for _, logFile := range logFiles {
-		f, err := os.Open(logFile)
-		if err != nil {
-			fmt.Printf("Error opening file %s: %v\n", logFile, err)
+// countReport prints the entries and lines of each input, followed by totals,
+// and returns the exit status: exitProcessingFailed when a file could not be
+// counted.
+func countReport(opts logmerge.Options) int {
+	files, err := logmerge.Count(opts)
+	switch {
+	case errors.Is(err, logmerge.ErrNoLogFiles):
+		infoOut.Infof("No .log files found in the specified directory or its subdirectories.")
+		return 0
+	case err != nil:
+		infoOut.Errorf("%v", err)
+		return 1
+	}
+	entries, lines, counted, failed := 0, 0, 0, 0
+	for _, file := range files {
+		if file.Err != nil {
+			infoOut.Errorf("%v", file.Err)
+			failed++
 			continue
 		}
-		defer f.Close()
-
-		reader := bufio.NewReader(f)
-		for {
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					break
-				}
-				fmt.Printf("Error reading line from %s: %v\n", logFile, err)
-				break
-			}
-			outFile.WriteString(line)
+		if file.Empty {
+			continue
 		}
+		fmt.Fprintf(os.Stdout, "%s\t%d entries\t%d lines\n", file.Input, file.Entries, file.LinesRead)
+		entries += file.Entries
+		lines += file.LinesRead
+		counted++
+	}
+	fmt.Fprintf(os.Stdout, "%d entries, %d lines in %d file(s).\n", entries, lines, counted)
+	if failed > 0 {
+		return exitProcessingFailed
 	}
-	fmt.Printf("Merged logs saved at: %s\n", outputFilePath)
+	return 0
 }
 
-func orderByDate(inputFilePath, outputFilePath, dateTimePattern string) {
-	content, err := os.ReadFile(inputFilePath)
+// dryRunReport prints each candidate file with its size and detected
+// timestamp format, followed by totals, and writes them to manifest.json. It
+// returns how many files have a recognizable format.
+func dryRunReport(opts logmerge.Options) int {
+	candidates, err := logmerge.Candidates(opts)
 	if err != nil {
-		fmt.Printf("Error reading file: %v\n", err)
-		return
+		infoOut.Errorf("%v", err)
+		os.Exit(1)
 	}
-
-	rawLines := strings.Split(strings.TrimRight(string(content), "\r\n"), "\n")
-	if dateTimePattern == "" {
-		// If no pattern found, just write them as-is
-		if err := os.WriteFile(outputFilePath, []byte(strings.Join(rawLines, "\n")), 0666); err != nil {
-			fmt.Printf("Error writing file: %v\n", err)
+	var totalSize int64
+	processable := 0
+	for _, c := range candidates {
+		totalSize += c.Size
+		if c.Processable {
+			processable++
 		}
-		return
+		fmt.Fprintf(os.Stdout, "%s\t%d bytes\t%s\n", c.Path, c.Size, c.Format)
 	}
+	fmt.Fprintf(os.Stdout, "%d file(s), %d bytes total, %d processable.\n", len(candidates), totalSize, processable)
 
-	var lines []LogLine
-	regex, _ := regexp.Compile(dateTimePattern)
-
-	for _, l := range rawLines {
-		timestamp, parseErr := parseTimestampFromLine(l, regex)
-		if parseErr != nil {
-			fmt.Printf("Warning: could not parse timestamp for line: %q - error: %v\n", l, parseErr)
-		}
-		lines = append(lines, LogLine{
-			Timestamp: timestamp, // zero time if parse fails
-			Raw:       l,
-		})
+	manifest := make([]logmerge.ManifestEntry, len(candidates))
+	for i, c := range candidates {
+		manifest[i] = c.ManifestEntry()
+	}
+	path := logmerge.ManifestPath(opts)
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err == nil {
+		err = logmerge.WriteManifest(path, manifest)
 	}
+	if err != nil {
+		infoOut.Errorf("%v", err)
+	} else {
+		infoOut.Infof("Manifest saved at: %s", path)
+	}
+	return processable
+}
 
-	sort.Slice(lines, func(i, j int) bool {
-		return lines[i].Timestamp.Before(lines[j].Timestamp)
-	})
+func displayHelp() {
+	fmt.Println("LogProcessor - A CLI tool to merge and order log files. Version:", getVersion())
+	fmt.Println()
+	fmt.Println("Usage:")
+	fmt.Println("  go run main.go --parentFolder \"C:\\path\\to\\log\\directory\"")
+	fmt.Println("  go run main.go <step> [options]   (run a single step; see Steps below)")
+	fmt.Println("Options:")
+	fmt.Println("  --parentFolder, -p    The path to the directory containing log files to be processed.")
+	fmt.Println("                        .log, .log.N (see --ext) and gzip-compressed .gz files are picked up. Repeat it,")
+	fmt.Println("                        or pass a comma-separated list, to merge several folders into one output.")
+	fmt.Println("  --files-from          Text file with one input path per line (blank lines and # comments are")
+	fmt.Println("                        skipped), merged in that order instead of searching --parentFolder.")
+	fmt.Println("                        Every path must exist; --include/--exclude, --ext and --rotated do not")
+	fmt.Println("                        apply. ProcessedLogs goes to --work-dir, --output-dir, --parentFolder or the")
+	fmt.Println("                        list's folder.")
+	fmt.Println("  --output-dir          Folder to create ProcessedLogs in (default: the first --parentFolder).")
+	fmt.Println("  --work-dir            Folder to use in place of ProcessedLogs, created if missing: processed")
+	fmt.Println("                        files, intermediates, the final file (unless --output is set),")
+	fmt.Println("                        manifest.json and the --incremental cache all go there, and nothing")
+	fmt.Println("                        is written under --parentFolder, e.g. for a read-only log mount.")
+	fmt.Println("  --recursive           Search subfolders too (default true). Use --recursive=false to only read")
+	fmt.Println("                        files directly in --parentFolder.")
+	fmt.Println("  --max-depth           How many subfolder levels to search: 1 reads direct subfolders only,")
+	fmt.Println("                        2 their subfolders as well, and so on (default 0, unlimited).")
+	fmt.Println("  --include             Only process files whose name matches this glob (repeatable).")
+	fmt.Println("  --exclude             Skip files whose name matches this glob (repeatable); wins over --include.")
+	fmt.Println("  --rotated             Treat numbered rotations of a file as one stream: app.log.2, app.log.1 and")
+	fmt.Println("                        app.log are merged oldest first, and entries with equal timestamps keep")
+	fmt.Println("                        that order.")
+	fmt.Println("  --ext                 Input file extension, repeatable (default log): --ext log --ext out picks")
+	fmt.Println("                        up app.log, app.out and rotated copies such as app.out.1. .gz files always.")
+	fmt.Println("  --dateLayout          Go time layout of the log timestamps, e.g. \"02/Jan/2006:15:04:05 -0700\".")
+	fmt.Println("  --datePattern         Regex matching the timestamp, e.g. \"\\d{2}/\\w{3}/\\d{4}:\\d{2}:\\d{2}:\\d{2} [+-]\\d{4}\".")
+	fmt.Println("                        Both must be given together; they disable timestamp auto-detection.")
+	fmt.Println("  --detect-lines        Non-blank lines scanned to detect the timestamp format (default 100).")
+	fmt.Println("  --fallback-modtime    Keep a file in which no timestamp can be found or parsed instead of")
+	fmt.Println("                        skipping it: each of its lines is ordered at the file's modification time,")
+	fmt.Println("                        plus one nanosecond per line so the file keeps its own order.")
+	fmt.Println("  --anchor              Only accept a timestamp at the very start of a line, for detection and")
+	fmt.Println("                        ordering alike, so a date quoted in a message or stack trace never starts")
+	fmt.Println("                        an entry. Also applies to --datePattern.")
+	fmt.Println("  --formats             Comma-separated built-in timestamp formats to detect, in priority order:")
+	fmt.Println("                        comma-ms (2023-06-01 12:34:56,789), dot-ms (2023-06-01 12:34:56.789),")
+	fmt.Println("                        iso8601 (2023-06-01T12:34:56.789Z) and syslog (Jun 01 12:34:56); all by")
+	fmt.Println("                        default. Leave one out if it matches text that is not a timestamp.")
+	fmt.Println("                        comma-ms and dot-ms also accept 2023-06-01 12:34:56 without fractional")
+	fmt.Println("                        seconds (taken as .000), alone or mixed with the other timestamps.")
+	fmt.Println("  --mixed-formats       For files that switch timestamp format part way, e.g. logs of several")
+	fmt.Println("                        services concatenated: a line with a timestamp in any of the --formats")
+	fmt.Println("                        starts an entry, not just one in the format detected at the top of the")
+	fmt.Println("                        file, which would take the others as continuation lines. Each line is")
+	fmt.Println("                        ordered by the first of the --formats, in order, that matches and parses.")
+	fmt.Println("                        Not with --datePattern.")
+	fmt.Println("  --assume-year         Year for timestamps without one, such as syslog's \"Jun 01 12:34:56.789\"")
+	fmt.Println("                        (default: the current year). It is the year of the last such timestamp in")
+	fmt.Println("                        each file; earlier ones move back a year at each December to January wrap.")
+	fmt.Println("  --json-input          Read the inputs as JSON lines: each object is an entry, ordered by the")
+	fmt.Println("                        timestamp in --ts-field (default \"ts\"; \"meta.time\" names a nested field),")
+	fmt.Println("                        in a built-in format or as Unix seconds or milliseconds. Lines are kept")
+	fmt.Println("                        exactly; those that are not such objects are reported as parse errors.")
+	fmt.Println("  --continuation-rule   Which lines belong to the entry before them: timestamp (default; every")
+	fmt.Println("                        line without a timestamp) or indent (lines starting with a space or tab,")
+	fmt.Println("                        and blank lines). With indent, an unindented line without a timestamp is")
+	fmt.Println("                        an entry of its own, ordered right after the entry before it.")
+	fmt.Println("  --encoding            Input encoding: auto (default; UTF-8, or UTF-16 when the file starts with")
+	fmt.Println("                        a byte order mark), utf8, utf16le or utf16be. Processing is in UTF-8.")
+	fmt.Println("  --encoding-out        Encoding of the final output: utf8 (default, never with a byte order mark),")
+	fmt.Println("                        utf16le or utf16be (with one). The intermediate files stay UTF-8.")
+	fmt.Println("  --max-line-bytes      Longest input line kept, e.g. 64KB or 1MB (default 0 = no limit). A longer")
+	fmt.Println("                        line is cut while it is read, so a single runaway line cannot exhaust")
+	fmt.Println("                        memory; the summary counts them and --verbose lists each one.")
+	fmt.Println("  --long-lines          What to do with lines over --max-line-bytes: truncate (default; keep the")
+	fmt.Println("                        first --max-line-bytes bytes) or drop. --json-input always drops them.")
+	fmt.Println("  --tz                  Rewrite timestamps in the output to this zone (e.g. UTC, Europe/Amsterdam).")
+	fmt.Println("                        By default the original text is kept; sorting always uses the absolute")
+	fmt.Println("                        instant, honouring offsets such as +02:00 or Z.")
+	fmt.Println("  --normalize-timestamps")
+	fmt.Println("                        Rewrite each entry's timestamp in RFC 3339, e.g. 2023-06-01T12:34:56.789Z,")
+	fmt.Println("                        in the --tz zone if given (a timestamp without an offset is taken as UTC).")
+	fmt.Println("                        Only the timestamp changes; entries where it cannot be parsed are kept.")
+	fmt.Println("  --ts-precision        Truncate the timestamps written by --normalize-timestamps and --format")
+	fmt.Println("                        json, and those --bucket files entries by, to ns (default), us, ms or s,")
+	fmt.Println("                        e.g. s for 2023-06-01T12:34:56Z. Ordering still uses full precision.")
+	fmt.Println("  --delimiter           Delimiter used to join continuation lines internally (default \\x00).")
+	fmt.Println("                        Occurrences in the logs are escaped and restored, so any value works")
+	fmt.Println("                        except one containing \\x1a, \\x1b or \\x1c.")
+	fmt.Println("  --stdin               Read one log stream from stdin and write the result to stdout.")
+	fmt.Println("                        Passing \"-\" as --parentFolder does the same.")
+	fmt.Println("  --prefix              Prepended to the name of every file this run writes to ProcessedLogs:")
+	fmt.Println("                        --prefix incident123- gives incident123-MERGED.log, incident123-manifest.json,")
+	fmt.Println("                        and so on. Runs with different prefixes can share one output folder; the")
+	fmt.Println("                        cleanup only removes files carrying this run's prefix.")
+	fmt.Println("  --output              Path of the final file (default: ProcessedLogs/FINAL_FORMATTED.log).")
+	fmt.Println("                        Missing parent directories are created. /dev/stdout, /dev/fd/N or an")
+	fmt.Println("                        existing named pipe is written as a stream instead of being replaced:")
+	fmt.Println("                        no .gz suffix is added and manifest.json stays in ProcessedLogs.")
+	fmt.Println("                        The final file, and its --bucket files, are never read as inputs.")
+	fmt.Println("  --dedup               Drop consecutive identical entries after sorting and report the count.")
+	fmt.Println("  --dedup-ignore-source With --dedup, compare entries without their --annotate-source tag.")
+	fmt.Println("  --dedup-global        Drop every repeat of an entry (timestamp and message, ignoring the source")
+	fmt.Println("                        tag), not just consecutive ones. Memory grows with the number of distinct")
+	fmt.Println("                        entries (a hash is kept for each), so prefer --dedup when it is enough.")
+	fmt.Println("  --collapse            Write each run of identical consecutive entries once, with \" (repeated N")
+	fmt.Println("                        times)\" after its first line, N counting the whole run. Only the final")
+	fmt.Println("                        file changes; unlike --dedup, repeats further apart are all kept.")
+	fmt.Println("  --collapse-ignore-timestamp")
+	fmt.Println("                        With --collapse, entries differing only in their timestamp are repeats;")
+	fmt.Println("                        the first one's timestamp is kept.")
+	fmt.Println("  --eol                 Line ending of the final file: auto (default; the ending most input")
+	fmt.Println("                        lines use), lf or crlf.")
+	fmt.Println("  --format              Final output format: text (default) or json. json writes one object per")
+	fmt.Println("                        entry with timestamp (RFC 3339), source, message and raw fields to")
+	fmt.Println("                        FINAL_FORMATTED.jsonl.")
+	fmt.Println("  --color               Highlight levels (ERROR red, WARN yellow, INFO green) with terminal colors.")
+	fmt.Println("                        Only when the output is a terminal (--stdin, or --output /dev/tty);")
+	fmt.Println("                        files and pipes never get color codes.")
+	fmt.Println("  --gzip                Write the final file gzip-compressed; \".gz\" is appended to its name.")
+	fmt.Println("  --gzip-level          Compression level for --gzip, -2 to 9 (default -1, gzip's default).")
+	fmt.Println("  --bucket              Split the final file by entry time, hour or day: FINAL_FORMATTED-2023-06-01-12.log")
+	fmt.Println("                        (or -2023-06-01) per bucket, named after --output when set. Entries whose")
+	fmt.Println("                        timestamp cannot be parsed go to FINAL_FORMATTED-unknown.log.")
+	fmt.Println("  --from, --to          Keep only entries within this time range (same format as the logs).")
+	fmt.Println("  --since               Keep only entries from the last duration, e.g. 2h or 30m, going by this")
+	fmt.Println("                        host's clock. Timestamps with a UTC offset (Z, +02:00) are compared as")
+	fmt.Println("                        instants; those without one as this host's local time. Combines with")
+	fmt.Println("                        --to; --from wins when both are set. With --watch it moves each run.")
+	fmt.Println("  --keep-unparsed       With --from/--to, keep lines without a timestamp next to the entry")
+	fmt.Println("                        before them (default true). Continuation lines always follow their entry.")
+	fmt.Println("  --tail                Keep only the N most recent entries, after all other filters. N counts")
+	fmt.Println("                        log entries, not physical lines: a stack trace belongs to its entry.")
+	fmt.Println("  --reverse             Order entries newest first. Entries with the same timestamp keep their")
+	fmt.Println("                        input order, so repeated runs give the same output.")
+	fmt.Println("  --no-sort             Skip ordering: entries keep their file-then-line order from MERGED.log,")
+	fmt.Println("                        e.g. when clocks differ between hosts. Multi-line entries are still")
+	fmt.Println("                        restored. Cannot be combined with the ordering filters.")
+	fmt.Println("  --level               Keep only entries at or above this level (TRACE, DEBUG, INFO, WARN, ERROR,")
+	fmt.Println("                        FATAL). Only an entry's first line is inspected; continuation lines follow it.")
+	fmt.Println("  --level-regex         Regex locating the level token (default matches the names above).")
+	fmt.Println("  --annotate-source     Insert the source file name after each entry's timestamp,")
+	fmt.Println("                        e.g. \"2023-06-01 12:34:56,789 [app-node2.log] INFO ...\".")
+	fmt.Println("  --redact-emails       Replace e-mail addresses with [REDACTED] before anything is written.")
+	fmt.Println("  --redact              Replace text matching this regex with [REDACTED] (repeatable), e.g.")
+	fmt.Println("                        \"(?i)bearer \\S+\". Take care not to match the timestamps.")
+	fmt.Println("  --max-memory          Merged size above which ordering uses an on-disk merge sort (default 1GB, 0 = never).")
+	fmt.Println("  --tmp-dir             Folder for the on-disk sort's temporary chunks (default: ProcessedLogs/sort-tmp).")
+	fmt.Println("                        They are removed when ordering ends, even if it fails.")
+	fmt.Println("  --workers             Number of log files processed concurrently (default: number of CPUs).")
+	fmt.Println("  --max-open-files      Most files open at once across all steps, whatever --workers is (at least")
+	fmt.Println("                        8). Workers wait for a free file, the on-disk sort merges its chunks in")
+	fmt.Println("                        several passes and --split-outputs reopens stream files as needed.")
+	fmt.Println("                        Default 0: the soft limit of the OS (ulimit -n) minus 16.")
+	fmt.Println("  --open-retries        How many times to retry opening an input after a transient error, such")
+	fmt.Println("                        as EAGAIN or a timeout on a network filesystem, waiting 100ms, then")
+	fmt.Println("                        200ms, and so on (default 3, 0 = never). A missing file or a denied")
+	fmt.Println("                        permission fails at once.")
+	fmt.Println("  --keep-intermediate   Keep every intermediate file (see Output files below).")
+	fmt.Println("  --keep                Comma-separated intermediates to keep: merged, ordered, processed.")
+	fmt.Println("  --incremental         Keep the processed files and a cache (ProcessedLogs/.cache.json) of each")
+	fmt.Println("                        input's size and modification time; the next --incremental run reuses")
+	fmt.Println("                        them for unchanged inputs. Changed or removed inputs are dropped.")
+	fmt.Println("  --force               With --incremental, process every input again (e.g. after changing --redact).")
+	fmt.Println("  --log-format          How messages are written to stderr: text (default) or json, one object")
+	fmt.Println("                        per line with time, level (info, warning or error) and msg. stdout only")
+	fmt.Println("                        carries results: --stdin output, --stats-json -, --preview, the --dry-run")
+	fmt.Println("                        and --count-only listings and the validate and diff reports.")
+	fmt.Println("  --quiet               Do not print the \"processed N/M\" progress counter.")
+	fmt.Println("  --progress            Print progress to stderr even when it is not a terminal.")
+	fmt.Println("  --verbose             Print a message after each pipeline step and a summary at the end: files")
+	fmt.Println("                        and bytes read, entries written, their time range and each step's duration.")
+	fmt.Println("  --slow-files          With --verbose, also list the N files that took longest to process, with")
+	fmt.Println("                        their size and line count (default 5, 0 = none).")
+	fmt.Println("  --stats-json          Write the same metrics, plus error counts, as one JSON object to this path,")
+	fmt.Println("                        or to stdout with \"-\". Not used with --stdin.")
+	fmt.Println("  --strict              Abort without output if any file cannot be processed. Without it the")
+	fmt.Println("                        remaining files are still merged, but the exit status is 2.")
+	fmt.Println("  --skip-empty          Skip empty or whitespace-only inputs, such as rotation placeholders,")
+	fmt.Println("                        instead of reporting an unrecognized date pattern. They are named with")
+	fmt.Println("                        --verbose, counted in the summary and marked \"empty\" in manifest.json.")
+	fmt.Println("  --strict-timestamps   Abort if a timestamp matches the date pattern but is invalid, e.g.")
+	fmt.Println("                        \"2023-13-40 10:00:00,000\". Without it such lines are listed in")
+	fmt.Println("                        ProcessedLogs/parse-errors.log and sorted with the entry before them.")
+	fmt.Println("  --skew-threshold      Warn about inputs whose time ranges overlap another input's by more")
+	fmt.Println("                        than this duration, e.g. 5m: a hint of clock skew between hosts that")
+	fmt.Println("                        makes the interleaving unreliable. Informational only (default 0, off).")
+	fmt.Println("  --on-collision        Inputs in different folders with the same name (e.g. a/app.log and")
+	fmt.Println("                        b/app.log) are listed in a warning, then: rename (default; processed as")
+	fmt.Println("                        app.log, app1.log, ...), skip (keep the first one found) or error.")
+	fmt.Println("  --dry-run             List candidate files with size and detected timestamp format, then exit")
+	fmt.Println("                        after writing only manifest.json. Exits 1 if no file is processable.")
+	fmt.Println("  --count-only          Print how many entries (a line with a timestamp and the lines continuing")
+	fmt.Println("                        it) and lines each file holds, and the totals, without writing anything.")
+	fmt.Println("                        Exits 2 if a file could not be counted, like a run that could not")
+	fmt.Println("                        process it.")
+	fmt.Println("  --preview             Process and order everything like a full run, then print only the first")
+	fmt.Println("                        N entries to stdout, formatted, instead of writing the final file and")
+	fmt.Println("                        manifest.json: a quick check of the detected pattern and the ordering")
+	fmt.Println("                        on a new log source (default 0, off).")
+	fmt.Println("  --watch               Keep running after the first run and run again whenever an input is")
+	fmt.Println("                        added, removed or written to, until Ctrl+C. The final file is replaced")
+	fmt.Println("                        atomically, so a reader never sees it half written. Pair it with")
+	fmt.Println("                        --incremental to only process the inputs that changed.")
+	fmt.Println("  --watch-interval      How often --watch checks the inputs' sizes and modification times; bursts")
+	fmt.Println("                        of writes cause at most one run per interval (default 2s).")
+	fmt.Println("  --split-by-regex      Regex whose first capture group names the stream an entry belongs to,")
+	fmt.Println("                        matched against its first line; e.g. '\\[(\\w+)\\]' for [auth] and [db] tags.")
+	fmt.Println("                        Each processed file is split into one file per stream (app-auth.log,")
+	fmt.Println("                        app-db.log, app-unmatched.log for entries without a match) before merging.")
+	fmt.Println("  --split-outputs       With --split-by-regex, write one final file per stream instead of one for")
+	fmt.Println("                        all, e.g. FINAL_FORMATTED-auth.log. Not with --bucket.")
+	fmt.Println("  --preserve-unparsed-position")
+	fmt.Println("                        Keep every entry without a parseable timestamp of its own at its place in")
+	fmt.Println("                        the merged stream (among the entries the filters keep) and sort only the")
+	fmt.Println("                        others into the remaining places. By default such an entry follows the")
+	fmt.Println("                        entry before it, so one before the first timestamp of a file sorts to")
+	fmt.Println("                        the top. --dedup and --tail apply to the result.")
+	fmt.Println("  --tiebreak-regex      Regex whose first capture group, found in an entry's first line, orders")
+	fmt.Println("                        entries with equal timestamps, e.g. 'req=(\\S+)'. Precedence: timestamp")
+	fmt.Println("                        (newest first with --reverse), then entries with a capture before those")
+	fmt.Println("                        without, then the captures compared byte by byte (always ascending),")
+	fmt.Println("                        then merge order. Lines without a timestamp keep following their entry.")
+	fmt.Println("  --show-all-warnings   Warn about every line ordering finds no parseable timestamp in. By default")
+	fmt.Println("                        the first 10 are shown, then a count of the others.")
+	fmt.Println("  --sort-files          Order the files found in the folders by name, modtime (newest first) or")
+	fmt.Println("                        size (largest first), ties by path. By default they keep the search order.")
+	fmt.Println("  --limit-files         Use only the first N files found, after --sort-files (default 0 = all),")
+	fmt.Println("                        e.g. for a quick look at a folder of thousands of logs. Neither flag")
+	fmt.Println("                        applies to --files-from.")
+	fmt.Println("  --per-file-output     Folder to copy each processed file to: its input with every multi-line")
+	fmt.Println("                        entry joined into a single line (continuation lines joined with")
+	fmt.Println("                        --delimiter), named after the input.")
+	fmt.Println("  --no-merge            With --per-file-output, stop once the inputs are processed, skipping the")
+	fmt.Println("                        merge, order and format steps: a batch line-joiner for multi-line logs.")
+	fmt.Println("  --config              JSON file of flag values, e.g. {\"parentFolder\": \"/var/log/app\", \"workers\": 4,")
+	fmt.Println("                        \"include\": [\"app-*.log\"]}. Keys are flag names; flags given on the")
+	fmt.Println("                        command line override the file. Unknown keys only print a warning.")
+	fmt.Println("  --version, -v         Print the version, the Go version it was built with and the build date.")
+	fmt.Println("  --help, -h            Display this help message.")
+	fmt.Println()
+	fmt.Println("Steps (each step accepts -h for its own options):")
+	fmt.Println("  process --in app.log --out app.processed.log")
+	fmt.Println("                        Join each multi-line entry into a single line; takes --max-line-bytes")
+	fmt.Println("                        and --long-lines.")
+	fmt.Println("  merge --out MERGED.log FILE...")
+	fmt.Println("                        Concatenate processed files in the given order.")
+	fmt.Println("  order --in MERGED.log --out MERGED_ORDERED.log")
+	fmt.Println("                        Sort by timestamp; takes --dateLayout/--datePattern, --from/--to,")
+	fmt.Println("                        --level, --dedup, --dedup-global, --tail, --reverse, --max-memory")
+	fmt.Println("                        and --tmp-dir.")
+	fmt.Println("  format --in MERGED_ORDERED.log --out FINAL_FORMATTED.log")
+	fmt.Println("                        Split entries back into lines; takes --format, --tz, --normalize-timestamps,")
+	fmt.Println("                        --ts-precision, --eol, --gzip, --bucket, --collapse and --split-by-regex")
+	fmt.Println("                        with --split-outputs.")
+	fmt.Println("  validate --in FINAL_FORMATTED.log")
+	fmt.Println("                        Check that the timestamps of a file never decrease (never increase with")
+	fmt.Println("                        --reverse) and report the first line out of order; exits with status 1")
+	fmt.Println("                        if there is one. --pattern is the same as --datePattern.")
+	fmt.Println("  diff --a OLD.log --b NEW.log")
+	fmt.Println("                        List the entries only one of two output files has, compared by the instant")
+	fmt.Println("                        of their timestamp and their text with white space collapsed, so a")
+	fmt.Println("                        reformatted timestamp or re-indented line is no difference. --format json")
+	fmt.Println("                        writes one object per entry: file (a or b), line, timestamp and text.")
+	fmt.Println()
+	fmt.Println("Output files (in <parentFolder>/ProcessedLogs, <output-dir>/ProcessedLogs or <work-dir>):")
+	fmt.Println("  <name>.log            One per input, each multi-line entry joined into a single line (processed).")
+	fmt.Println("  MERGED.log            All processed files concatenated in input order (merged).")
+	fmt.Println("  MERGED_ORDERED.log    MERGED.log sorted by timestamp (ordered).")
+	fmt.Println("  FINAL_FORMATTED.log   The ordered entries split back into their original lines; kept by default.")
+	fmt.Println("  parse-errors.log      Lines whose timestamp could not be parsed, as file:line: error: text.")
+	fmt.Println("                        Only written when there are any; kept by default.")
+	fmt.Println("  manifest.json         Every input with its size, modification time, detected pattern, bytes and")
+	fmt.Println("                        lines read, and why it was skipped, if it was. Written next to --output")
+	fmt.Println("                        when that is set; kept by default.")
+	fmt.Println("  skipped.json          Every input left out, as {path, reason, error}: excluded, limit-files,")
+	fmt.Println("                        duplicate name, permission denied, unreadable, empty, unrecognized date")
+	fmt.Println("                        pattern or failed. The counts by reason are printed at the end of the")
+	fmt.Println("                        run and added to --stats-json. Kept by default.")
+	fmt.Println()
+	fmt.Println("Environment:")
+	fmt.Println("  Every flag can also be set with an environment variable named after it: MERGEORDERLOG_ and the")
+	fmt.Println("  flag name in upper case, with a _ between words, e.g. MERGEORDERLOG_PARENT_FOLDER,")
+	fmt.Println("  MERGEORDERLOG_WORKERS or MERGEORDERLOG_DRY_RUN=true. A flag given on the command line wins over")
+	fmt.Println("  its variable, which wins over --config and the default. Repeatable flags take a single value;")
+	fmt.Println("  steps read the same variables.")
+	fmt.Println()
+}
 
-	sortedLines := make([]string, 0, len(lines))
-	for _, line := range lines {
-		sortedLines = append(sortedLines, line.Raw)
-	}
+// envPrefix starts the name of the environment variable of every flag.
+const envPrefix = "MERGEORDERLOG_"
 
-	if err := os.WriteFile(outputFilePath, []byte(strings.Join(sortedLines, "\n")), 0666); err != nil {
-		fmt.Printf("Error writing file: %v\n", err)
-		return
+// envName returns the environment variable of a flag: parentFolder becomes
+// MERGEORDERLOG_PARENT_FOLDER and max-memory MERGEORDERLOG_MAX_MEMORY.
+func envName(flagName string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	for i, r := range flagName {
+		switch {
+		case r == '-':
+			b.WriteByte('_')
+		case unicode.IsUpper(r):
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune(unicode.ToUpper(r))
+		}
 	}
+	return b.String()
 }
 
-func parseTimestampFromLine(line string, pattern *regexp.Regexp) (time.Time, error) {
-	match := pattern.FindString(line)
-	if match == "" {
-		return time.Time{}, fmt.Errorf("no timestamp found in line: %s", line)
-	}
-	normalized := strings.Replace(match, ",", ".", 1)
-	parsed, err := time.Parse(dateLayoutDefault, normalized)
-	if err != nil {
-		return time.Time{}, err
-	}
-	return parsed, nil
+// applyEnv sets every flag of fs that was not given on the command line from
+// its environment variable (see envName), when that is set, and returns the
+// values it set so that a --config file leaves them alone. One-letter aliases
+// such as -p and --version have no variable, and a repeatable flag takes a
+// single value.
+func applyEnv(fs *flag.FlagSet) ([]flag.Value, error) {
+	var explicit, fromEnv []flag.Value
+	fs.Visit(func(f *flag.Flag) { explicit = append(explicit, f.Value) })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || len(f.Name) == 1 || f.Name == "version" || slices.Contains(explicit, f.Value) || slices.Contains(fromEnv, f.Value) {
+			return
+		}
+		name := envName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", value, name, setErr)
+			return
+		}
+		fromEnv = append(fromEnv, f.Value)
+	})
+	return fromEnv, err
 }
 
-func formatSupport(inputFilePath, outputFilePath, dateTimePattern string) {
-	inFile, err := os.Open(inputFilePath)
+// loadConfig applies the flag values stored in the JSON object at path. Keys
+// are flag names; a flag already given on the command line, or through one of
+// its aliases such as -p, keeps its command-line value, and one set from the
+// environment (fromEnv, see applyEnv) its environment value. Arrays set
+// repeatable flags like --include once per element.
+func loadConfig(path string, fromEnv []flag.Value) error {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		fmt.Printf("Error opening file: %v\n", err)
-		return
+		return fmt.Errorf("error reading config %s: %v", path, err)
 	}
-	defer inFile.Close()
-
-	outFile, err := os.Create(outputFilePath)
-	if err != nil {
-		fmt.Printf("Error creating file: %v\n", err)
-		return
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var values map[string]interface{}
+	if err := decoder.Decode(&values); err != nil {
+		return fmt.Errorf("error parsing config %s: %v", path, err)
 	}
-	defer outFile.Close()
 
-	reader := bufio.NewReader(inFile)
-	regex, _ := regexp.Compile(dateTimePattern)
-	var logBuffer []string
-
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
+	explicit := slices.Clone(fromEnv)
+	flag.Visit(func(f *flag.Flag) { explicit = append(explicit, f.Value) })
+	isExplicit := func(v flag.Value) bool {
+		for _, e := range explicit {
+			if e == v {
+				return true
 			}
-			fmt.Printf("Error reading line: %v\n", err)
-			break
 		}
-		line = strings.TrimRight(line, "\r\n")
+		return false
+	}
 
-		if regex.MatchString(line) {
-			// Flush the buffer first
-			if len(logBuffer) > 0 {
-				for _, l := range logBuffer {
-					outFile.WriteString(l + "\n")
-				}
-				logBuffer = nil
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		f := flag.Lookup(key)
+		if f == nil || key == "config" || key == "h" {
+			infoOut.Warnf("ignoring unknown key %q in config %s.", key, path)
+			continue
+		}
+		if isExplicit(f.Value) {
+			continue
+		}
+		items, ok := values[key].([]interface{})
+		if !ok {
+			items = []interface{}{values[key]}
+		}
+		for _, item := range items {
+			var value string
+			switch v := item.(type) {
+			case string:
+				value = v
+			case json.Number, bool:
+				value = fmt.Sprint(v)
+			default:
+				return fmt.Errorf("config %s: unsupported value for %q", path, key)
 			}
-			// Split the current line on continuation delimiter
-			segments := strings.Split(line, lineContinuationDelimiter)
-			for _, seg := range segments {
-				outFile.WriteString(seg + "\n")
+			if err := f.Value.Set(value); err != nil {
+				return fmt.Errorf("config %s: invalid value %q for %q: %v", path, value, key, err)
 			}
-		} else {
-			// Accumulate in buffer
-			logBuffer = append(logBuffer, line)
 		}
 	}
+	return nil
+}
 
-	// Flush any remaining buffer
-	if len(logBuffer) > 0 {
-		for _, l := range logBuffer {
-			outFile.WriteString(l + "\n")
+// parseTimeWindow parses the --from/--to values, which use the same timestamp
+// format as the log lines. Without from, since (a duration) sets the start;
+// it is resolved against the clock on each run, see logmerge.Options.Since.
+func parseTimeWindow(from, to, since, layout string) (fromTime, toTime time.Time, sinceDur time.Duration, err error) {
+	if from != "" {
+		if fromTime, err = logmerge.ParseTimestamp(from, layout); err != nil {
+			return fromTime, toTime, 0, fmt.Errorf("invalid --from %q: %v", from, err)
+		}
+	} else if since != "" {
+		if sinceDur, err = time.ParseDuration(since); err != nil || sinceDur <= 0 {
+			return fromTime, toTime, 0, fmt.Errorf("invalid --since %q: must be a positive duration such as 2h or 30m", since)
+		}
+	}
+	if to != "" {
+		if toTime, err = logmerge.ParseTimestamp(to, layout); err != nil {
+			return fromTime, toTime, 0, fmt.Errorf("invalid --to %q: %v", to, err)
+		}
+	}
+	if sinceDur > 0 && !toTime.IsZero() {
+		// Only an error when --to is before the start read either way:
+		// as an instant, or as this host's wall clock
+		start := time.Now().Add(-sinceDur)
+		wall := time.Date(start.Year(), start.Month(), start.Day(), start.Hour(), start.Minute(), start.Second(), start.Nanosecond(), time.UTC)
+		if toTime.Before(start) && toTime.Before(wall) {
+			return fromTime, toTime, 0, fmt.Errorf("--to %q is before --since %s", to, since)
 		}
 	}
+	if !fromTime.IsZero() && !toTime.IsZero() && toTime.Before(fromTime) {
+		return fromTime, toTime, 0, fmt.Errorf("--to %q is before --from %q", to, from)
+	}
+	return fromTime, toTime, sinceDur, nil
 }
 
-func cleanupProcessFolder(processFolder, finalFilePath string) {
-	entries, err := os.ReadDir(processFolder)
-	if err != nil {
-		fmt.Printf("Error reading directory: %v\n", err)
-		return
+// parseByteSize parses sizes such as "512MB", "2G" or "1048576".
+func parseByteSize(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"TB", 1 << 40},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+		{"B", 1},
 	}
-	for _, e := range entries {
-		fullPath := filepath.Join(processFolder, e.Name())
-		if fullPath == finalFilePath {
-			continue
+	number, scale := strings.ToUpper(strings.TrimSpace(value)), int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(number, u.suffix) {
+			number, scale = strings.TrimSpace(strings.TrimSuffix(number, u.suffix)), u.scale
+			break
 		}
-		if err := os.RemoveAll(fullPath); err != nil {
-			fmt.Printf("Error removing %s: %v\n", fullPath, err)
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("expected a non-negative size such as 512MB")
+	}
+	if n > math.MaxInt64/scale {
+		return 0, errors.New("size is too large")
+	}
+	return n * scale, nil
+}
+
+// emailPattern matches the e-mail addresses removed by --redact-emails.
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+
+// redactor builds the LineTransform for --redact-emails and --redact, or
+// returns nil when neither is set.
+func redactor(emails bool, patterns []string) (func(source, line string) string, error) {
+	var regexes []*regexp.Regexp
+	if emails {
+		regexes = append(regexes, emailPattern)
+	}
+	for _, pattern := range patterns {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --redact %q: %v", pattern, err)
 		}
+		regexes = append(regexes, regex)
 	}
+	if len(regexes) == 0 {
+		return nil, nil
+	}
+	return func(_, line string) string {
+		for _, regex := range regexes {
+			line = regex.ReplaceAllLiteralString(line, "[REDACTED]")
+		}
+		return line
+	}, nil
+}
+
+// parseDelimiter interprets Go escape sequences (e.g. \x00, \t) in the
+// --delimiter value so control characters can be passed on the command line.
+func parseDelimiter(value string) (string, error) {
+	delimiter, err := strconv.Unquote(`"` + strings.ReplaceAll(value, `"`, `\"`) + `"`)
+	if err != nil {
+		return "", fmt.Errorf("invalid --delimiter %q: %v", value, err)
+	}
+	if delimiter == "" {
+		return "", errors.New("--delimiter must not be empty")
+	}
+	return delimiter, nil
+}
+
+// isTerminal reports whether f is attached to a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
 
 func getVersion() string {
 	return version
 }
+
+// printVersion prints the --version report.
+func printVersion() {
+	fmt.Println("MergeOrderLog", getVersion())
+	fmt.Println("Go:", runtime.Version())
+	if buildDate != "" {
+		fmt.Println("Built:", buildDate)
+	}
+}